@@ -0,0 +1,155 @@
+package cmd
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "os"
+  "fmt"
+
+  "github.com/spf13/cobra"
+
+  "github.com/lancs-net/wayfinder/log"
+  "github.com/lancs-net/wayfinder/job"
+)
+
+type DoctorConfig struct {
+  CpuSets     string
+  WorkDir     string
+  HostNetwork string
+  BridgeName  string
+  MinFree     float64
+}
+
+var (
+  doctorCmd = &cobra.Command{
+    Use: "doctor [OPTIONS...] [FILE]",
+    Short: `Check the host is ready to run experiment jobs`,
+    Run: doDoctorCmd,
+    Args: cobra.MaximumNArgs(1),
+    DisableFlagsInUseLine: true,
+  }
+  doctorConfig = &DoctorConfig{}
+)
+
+func init() {
+  doctorCmd.Flags().StringVar(
+    &doctorConfig.CpuSets,
+    "cpu-sets",
+    defaultCpuSets(),
+    "Specify which CPUs experiments will run on.",
+  )
+  doctorCmd.Flags().StringVarP(
+    &doctorConfig.WorkDir,
+    "workdir",
+    "w",
+    "",
+    "Specify working directory for outputting results, data, file systems, etc.",
+  )
+  doctorCmd.Flags().StringVarP(
+    &doctorConfig.HostNetwork,
+    "hostnet",
+    "n",
+    "eth0",
+    "Host network interface which the bridge is NAT'd to.",
+  )
+  doctorCmd.Flags().StringVarP(
+    &doctorConfig.BridgeName,
+    "bridge",
+    "b",
+    "wayfinder0",
+    "",
+  )
+  doctorCmd.Flags().Float64Var(
+    &doctorConfig.MinFree,
+    "min-free",
+    10,
+    "Minimum free disk space in GiB required in the working directory.",
+  )
+}
+
+// doDoctorCmd runs the pre-flight checks and exits non-zero if any failed
+func doDoctorCmd(cmd *cobra.Command, args []string) {
+  cpus, err := parseCpuSets(doctorConfig.CpuSets)
+  if err != nil {
+    log.Errorf("Could not parse CPU sets: %s", err)
+    os.Exit(1)
+  }
+
+  if doctorConfig.WorkDir == "" {
+    doctorConfig.WorkDir, err = os.Getwd()
+    if err != nil {
+      log.Fatal("Could not use current directory as workdir: ", err)
+      os.Exit(1)
+    }
+  }
+
+  var j *job.Job
+  if len(args) > 0 {
+    j, _, err = job.ParseJob(args[0])
+    if err != nil {
+      log.Errorf("Could not read configuration: %s", err)
+      os.Exit(1)
+    }
+  }
+
+  checks := job.Doctor(j, &job.RuntimeConfig{
+    Cpus:        cpus,
+    BridgeName:  doctorConfig.BridgeName,
+    BridgeIface: doctorConfig.HostNetwork,
+    WorkDir:     doctorConfig.WorkDir,
+  }, uint64(doctorConfig.MinFree * (1 << 30)))
+
+  failed := 0
+  for _, check := range checks {
+    status := "PASS"
+    detail := check.Detail
+    if check.Err != nil {
+      detail = check.Err.Error()
+      if check.Warn {
+        status = "WARN"
+      } else {
+        status = "FAIL"
+        failed++
+      }
+    }
+
+    if len(detail) > 0 {
+      fmt.Printf("[%s] %s: %s\n", status, check.Name, detail)
+    } else {
+      fmt.Printf("[%s] %s\n", status, check.Name)
+    }
+  }
+
+  if failed > 0 {
+    fmt.Printf("\n%d of %d checks failed\n", failed, len(checks))
+    os.Exit(1)
+  }
+}
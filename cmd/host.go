@@ -0,0 +1,100 @@
+package cmd
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "os"
+
+  "github.com/spf13/cobra"
+
+  "github.com/lancs-net/wayfinder/log"
+  "github.com/lancs-net/wayfinder/job"
+)
+
+type HostConfig struct {
+  WorkDir string
+  DryRun  bool
+}
+
+var (
+  hostCmd = &cobra.Command{
+    Use: "host",
+    Short: `Manage the state of the host`,
+    DisableFlagsInUseLine: true,
+  }
+  hostRestoreCmd = &cobra.Command{
+    Use: "restore [OPTIONS...]",
+    Short: `Revert host changes left behind by a job which did not exit cleanly`,
+    Run: doHostRestoreCmd,
+    Args: cobra.NoArgs,
+    DisableFlagsInUseLine: true,
+  }
+  hostConfig = &HostConfig{}
+)
+
+func init() {
+  hostRestoreCmd.Flags().StringVarP(
+    &hostConfig.WorkDir,
+    "workdir",
+    "w",
+    "",
+    "Working directory of the job whose host changes should be reverted.",
+  )
+  hostRestoreCmd.Flags().BoolVarP(
+    &hostConfig.DryRun,
+    "dry-run",
+    "D",
+    false,
+    "Show the changes without reverting them.",
+  )
+
+  hostCmd.AddCommand(hostRestoreCmd)
+}
+
+// doHostRestoreCmd reverts the host from the journal in the working directory
+func doHostRestoreCmd(cmd *cobra.Command, args []string) {
+  var err error
+
+  // Use the current directory as workdir if unset, like `run` does
+  if hostConfig.WorkDir == "" {
+    hostConfig.WorkDir, err = os.Getwd()
+    if err != nil {
+      log.Fatal("Could not use current directory as workdir: ", err)
+      os.Exit(1)
+    }
+  }
+
+  err = job.RestoreEnvironment(job.HostJournal(hostConfig.WorkDir), hostConfig.DryRun)
+  if err != nil {
+    log.Errorf("Could not restore host: %s", err)
+    os.Exit(1)
+  }
+}
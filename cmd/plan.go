@@ -0,0 +1,158 @@
+package cmd
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "os"
+  "fmt"
+  "time"
+  "strings"
+
+  "github.com/spf13/cobra"
+
+  "github.com/lancs-net/wayfinder/log"
+  "github.com/lancs-net/wayfinder/job"
+)
+
+type PlanConfig struct {
+  CpuSets string
+  RunTime time.Duration
+  Samples int
+}
+
+var (
+  planCmd = &cobra.Command{
+    Use: "plan [OPTIONS...] [FILE]",
+    Short: `Validate a job and show the tasks it would run`,
+    Run: doPlanCmd,
+    Args: cobra.ExactArgs(1),
+    DisableFlagsInUseLine: true,
+  }
+  planConfig = &PlanConfig{}
+)
+
+func init() {
+  planCmd.Flags().StringVar(
+    &planConfig.CpuSets,
+    "cpu-sets",
+    defaultCpuSets(),
+    "Specify which CPUs experiments will run on.",
+  )
+  planCmd.Flags().DurationVar(
+    &planConfig.RunTime,
+    "run-time",
+    time.Minute,
+    "Estimated duration of a single run.",
+  )
+  planCmd.Flags().IntVar(
+    &planConfig.Samples,
+    "samples",
+    5,
+    "Number of permutations to show.",
+  )
+}
+
+// doPlanCmd expands the parameters of the job and summarises what it would run
+func doPlanCmd(cmd *cobra.Command, args []string) {
+  cpus, err := parseCpuSets(planConfig.CpuSets)
+  if err != nil {
+    log.Errorf("Could not parse CPU sets: %s", err)
+    os.Exit(1)
+  }
+
+  j, tasks, err := job.PlanJob(args[0])
+  if err != nil {
+    log.Errorf("Invalid job %s: %s", args[0], err)
+    os.Exit(1)
+  }
+
+  // Runs of a task are sequential and hold their cores for their duration
+  cores := 0
+  maxCores := 0
+  for _, r := range j.Runs {
+    cores += r.Cores
+    if r.Cores > maxCores {
+      maxCores = r.Cores
+    }
+  }
+
+  coreHours := float64(len(tasks)*cores) * planConfig.RunTime.Hours()
+
+  fmt.Printf("Job:        %s\n", args[0])
+  fmt.Printf("Parameters: %d\n", len(j.AllParams()))
+  fmt.Printf("Tasks:      %d\n", len(tasks))
+  if len(j.Constraints) > 0 {
+    fmt.Printf("Excluded:   %d\n", j.Excluded())
+    for _, exclusion := range j.Exclusions() {
+      fmt.Printf("  %6d  %s\n", exclusion.Excluded, exclusion.Constraint)
+    }
+  }
+  fmt.Printf("Runs:       %d (%d per task)\n", len(tasks)*len(j.Runs), len(j.Runs))
+  fmt.Printf("Core-hours: %.2f (at %s per run)\n", coreHours, planConfig.RunTime)
+  if len(cpus) > 0 {
+    wall := time.Duration(coreHours / float64(len(cpus)) * float64(time.Hour))
+    fmt.Printf("Wall time:  at least %s on %d CPUs\n", wall.Round(time.Second), len(cpus))
+  }
+
+  if len(tasks) > 0 && planConfig.Samples > 0 {
+    fmt.Printf("\nPermutations:\n")
+    for i, task := range tasks {
+      if i == planConfig.Samples {
+        fmt.Printf("  ... %d more\n", len(tasks) - i)
+        break
+      }
+
+      var params []string
+      for _, param := range task.Params {
+        params = append(params, fmt.Sprintf("%s=%s", param.Name, param.Value))
+      }
+      for _, param := range task.Derived {
+        params = append(params, fmt.Sprintf("(%s=%s)", param.Name, param.Value))
+      }
+      fmt.Printf("  %s  %s\n", task.UUID(), strings.Join(params, " "))
+    }
+  }
+
+  fmt.Printf("\nCPU sets:\n")
+  fits := true
+  for _, r := range j.Runs {
+    if r.Cores > len(cpus) {
+      fits = false
+      fmt.Printf("  [FAIL] %s: %d cores > %d CPUs\n", r.Name, r.Cores, len(cpus))
+    } else {
+      fmt.Printf("  [PASS] %s: %d of %d CPUs\n", r.Name, r.Cores, len(cpus))
+    }
+  }
+
+  if !fits {
+    os.Exit(1)
+  }
+}
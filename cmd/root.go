@@ -74,6 +74,10 @@ func init() {
 	// Subcommands
 	rootCmd.AddCommand(runCmd)
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(hostCmd)
+	rootCmd.AddCommand(doctorCmd)
+	rootCmd.AddCommand(planCmd)
+	rootCmd.AddCommand(schemaCmd)
   rootCmd.AddCommand(runcInitCmd)
 }
 
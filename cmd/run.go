@@ -54,7 +54,10 @@ type RunConfig struct {
   HostNetwork   string
   BridgeName    string
   BridgeSubnet  string
+  BridgeMTU     int
+  IsolatedNet   string
   MaxRetries    int
+  Quiet         bool
 }
 
 var (
@@ -73,7 +76,7 @@ func init() {
   runCmd.PersistentFlags().StringVar(
     &runConfig.CpuSets,
     "cpu-sets",
-    fmt.Sprintf("2-%d", runtime.NumCPU()),
+    defaultCpuSets(),
     "Specify which CPUs to run experiments on.",
   )
   runCmd.PersistentFlags().BoolVarP(
@@ -109,7 +112,7 @@ func init() {
     "hostnet",
     "n",
     "eth0",
-    "",
+    "Host network interface which the bridge is NAT'd to.",
   )
   runCmd.PersistentFlags().StringVarP(
     &runConfig.BridgeName,
@@ -125,6 +128,18 @@ func init() {
     "172.88.0.1/16",
     "",
   )
+  runCmd.PersistentFlags().IntVar(
+    &runConfig.BridgeMTU,
+    "mtu",
+    1500,
+    "MTU of the bridge.",
+  )
+  runCmd.PersistentFlags().StringVar(
+    &runConfig.IsolatedNet,
+    "isolated-subnet",
+    "172.89.0.0/16",
+    "Subnet from which isolated networks of tasks are allocated.",
+  )
   runCmd.PersistentFlags().IntVarP(
     &runConfig.MaxRetries,
     "max-retries",
@@ -132,6 +147,13 @@ func init() {
     0,
     "Maximum number of retries for a run.",
   )
+  runCmd.PersistentFlags().BoolVarP(
+    &runConfig.Quiet,
+    "quiet",
+    "q",
+    false,
+    "Do not echo the output of runs, which is still captured with the results.",
+  )
 }
 
 // doRunCmd 
@@ -168,15 +190,23 @@ func doRunCmd(cmd *cobra.Command, args []string) {
     os.MkdirAll(rersultsDir, os.ModePerm)
   }
 
-  activeJob, err := job.NewJob(args[0], &job.RuntimeConfig{
+  activeJob, err = job.NewJob(args[0], &job.RuntimeConfig{
     Cpus:          cpus,
     BridgeName:    runConfig.BridgeName,
     BridgeIface:   runConfig.HostNetwork,
     BridgeSubnet:  runConfig.BridgeSubnet,
+    BridgeMTU:     runConfig.BridgeMTU,
+    IsolatedSubnet: runConfig.IsolatedNet,
     ScheduleGrace: runConfig.ScheduleGrace,
     AllowOverride: runConfig.AllowOverride,
     WorkDir:       runConfig.WorkDir,
     MaxRetries:    runConfig.MaxRetries,
+    Quiet:         runConfig.Quiet,
+    Software:      job.Software{
+      Version:   version.Version,
+      Commit:    version.Commit,
+      BuildTime: version.BuildTime,
+    },
   }, runConfig.DryRun)
 	if err != nil {
 		log.Fatalf("Could not read configuration: %s", err)
@@ -186,7 +216,7 @@ func doRunCmd(cmd *cobra.Command, args []string) {
   setupInterruptHandler()
 
   // Prepare environment
-  err = job.PrepareEnvironment(cpus, runConfig.DryRun)
+  err = activeJob.PrepareEnvironment(cpus)
   if err != nil {
     log.Errorf("Could not prepare environment: %s", err)
     cleanup()
@@ -197,13 +227,20 @@ func doRunCmd(cmd *cobra.Command, args []string) {
   err = activeJob.Start()
   if err != nil {
     log.Errorf("Could not start job: %s", err)
-    cleanup()
   }
 
   // We're all done now
   cleanup()
 }
 
+// defaultCpuSets leaves the first two CPUs to the host, unless it has no others
+func defaultCpuSets() string {
+  if runtime.NumCPU() > 2 {
+    return fmt.Sprintf("2-%d", runtime.NumCPU())
+  }
+  return fmt.Sprintf("0-%d", runtime.NumCPU())
+}
+
 func parseCpuSets(cpuSets string) ([]int, error) {
   var cpus []int
   
@@ -272,7 +309,8 @@ func cleanup() {
     log.Warnf("Could not delete container cache: %s", err)
   }
 
-  job.RevertEnvironment(runConfig.DryRun)
-
-  // TODO: Clean up bridge
+  err = job.RevertEnvironment(runConfig.DryRun)
+  if err != nil {
+    log.Warnf("%s, run `wayfinder host restore` to retry", err)
+  }
 }
@@ -0,0 +1,363 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "fmt"
+  "path"
+  "strings"
+  "io/ioutil"
+  "crypto/sha256"
+  "path/filepath"
+
+  "gopkg.in/yaml.v3"
+)
+
+// RunDefaults are the attributes which runs of the job inherit unless they set
+// them themselves
+type RunDefaults struct {
+  Image          string `yaml:"image"`
+  Cores          int    `yaml:"cores"`
+  Devices      []string `yaml:"devices"`
+  Capabilities []string `yaml:"capabilities"`
+}
+
+// jobDoc is a job file merged with the files it includes, along with the file
+// each node was read from so that errors can be located in the right file
+type jobDoc struct {
+  root     *yaml.Node
+  files     map[*yaml.Node]string
+  includes []JobFile
+}
+
+// fileOf returns the file the node was read from
+func (d *jobDoc) fileOf(n *yaml.Node) string {
+  return d.files[n]
+}
+
+// errorf returns an error located at the node
+func (d *jobDoc) errorf(n *yaml.Node, format string, a ...interface{}) error {
+  return fmt.Errorf(
+    "%s:%d:%d: %s", d.fileOf(n), n.Line, n.Column, fmt.Sprintf(format, a...),
+  )
+}
+
+// loadJobDoc reads the job file and merges the files it includes into it.  The
+// lists of included files, such as inputs or runs, come before those of the
+// job, whereas its other values take precedence.
+func loadJobDoc(filePath string, dat []byte) (*jobDoc, error) {
+  d := &jobDoc{files: make(map[*yaml.Node]string)}
+
+  root, err := d.load(path.Clean(filePath), dat, nil)
+  if err != nil {
+    return nil, err
+  }
+
+  d.root = root
+  return d, nil
+}
+
+// load decodes a file, which may include others relative to itself, into a
+// mapping node.  The stack of files being included is used to detect cycles.
+func (d *jobDoc) load(file string, dat []byte, stack []string) (*yaml.Node, error) {
+  var doc yaml.Node
+  err := yaml.Unmarshal(dat, &doc)
+  if err != nil {
+    return nil, fmt.Errorf("%s: %s", file, err)
+  }
+
+  root := &yaml.Node{Kind: yaml.MappingNode, Line: 1, Column: 1}
+  if len(doc.Content) > 0 {
+    root = doc.Content[0]
+  }
+  d.register(root, file)
+
+  if root.Kind != yaml.MappingNode {
+    return nil, d.errorf(root, "expected a mapping of the job's attributes")
+  }
+
+  err = resolveSources(root, path.Dir(file))
+  if err != nil {
+    return nil, err
+  }
+
+  // Remove the includes from the document, which are merged in their place
+  var include *yaml.Node
+  var content []*yaml.Node
+  for i := 0; i+1 < len(root.Content); i += 2 {
+    if root.Content[i].Value == "include" {
+      include = root.Content[i+1]
+    } else {
+      content = append(content, root.Content[i], root.Content[i+1])
+    }
+  }
+  root.Content = content
+
+  if include == nil {
+    return root, nil
+  } else if include.Kind != yaml.SequenceNode {
+    return nil, d.errorf(include, "include: expected a list of files")
+  }
+
+  stack = append(stack, file)
+  merged := &yaml.Node{Kind: yaml.MappingNode}
+  for _, item := range include.Content {
+    if item.Kind != yaml.ScalarNode {
+      return nil, d.errorf(item, "include: expected a file")
+    }
+
+    inc := item.Value
+    if !path.IsAbs(inc) {
+      inc = path.Join(path.Dir(file), inc)
+    }
+    inc = path.Clean(inc)
+
+    for _, f := range stack {
+      if f == inc {
+        return nil, d.errorf(item,
+          "Include cycle: %s -> %s", strings.Join(stack, " -> "), inc,
+        )
+      }
+    }
+
+    incDat, err := ioutil.ReadFile(inc)
+    if err != nil {
+      return nil, d.errorf(item, "Could not include %s: %s", inc, err)
+    }
+
+    d.includes = append(d.includes, JobFile{
+      Path:   inc,
+      SHA256: fmt.Sprintf("%x", sha256.Sum256(incDat)),
+    })
+
+    node, err := d.load(inc, incDat, stack)
+    if err != nil {
+      return nil, err
+    }
+
+    merged = d.merge(merged, node)
+  }
+
+  return d.merge(merged, root), nil
+}
+
+// resolveSources makes the relative sources of the inputs declared by a file
+// absolute, relative to the directory of the file rather than the working
+// directory
+func resolveSources(root *yaml.Node, dir string) error {
+  inputs := mappingValue(root, "inputs")
+  if inputs == nil || inputs.Kind != yaml.SequenceNode {
+    return nil
+  }
+
+  dir, err := filepath.Abs(dir)
+  if err != nil {
+    return err
+  }
+
+  for _, input := range inputs.Content {
+    source := mappingValue(input, "source")
+    if source != nil && source.Kind == yaml.ScalarNode &&
+       len(source.Value) > 0 && !path.IsAbs(source.Value) {
+      source.Value = path.Join(dir, source.Value)
+    }
+  }
+
+  return nil
+}
+
+// register records the file of the node and of all nodes within it
+func (d *jobDoc) register(n *yaml.Node, file string) {
+  if _, ok := d.files[n]; ok {
+    return
+  }
+
+  d.files[n] = file
+  for _, c := range n.Content {
+    d.register(c, file)
+  }
+}
+
+// merge merges two nodes, where mappings are merged key by key, sequences are
+// concatenated and other nodes of over replace those of base.  New nodes are
+// located where over is.
+func (d *jobDoc) merge(base, over *yaml.Node) *yaml.Node {
+  if base.Kind != over.Kind || (over.Kind != yaml.MappingNode && over.Kind != yaml.SequenceNode) {
+    return over
+  }
+
+  merged := *over
+  merged.Content = nil
+  d.files[&merged] = d.files[over]
+
+  if over.Kind == yaml.SequenceNode {
+    merged.Content = append(append(merged.Content, base.Content...), over.Content...)
+    return &merged
+  }
+
+  for i := 0; i+1 < len(base.Content); i += 2 {
+    key, value := base.Content[i], base.Content[i+1]
+    if o := mappingValue(over, key.Value); o != nil {
+      value = d.merge(value, o)
+    }
+    merged.Content = append(merged.Content, key, value)
+  }
+
+  for i := 0; i+1 < len(over.Content); i += 2 {
+    if mappingValue(base, over.Content[i].Value) == nil {
+      merged.Content = append(merged.Content, over.Content[i], over.Content[i+1])
+    }
+  }
+
+  return &merged
+}
+
+// mappingValue returns the value of the key within a mapping node
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+  if n == nil || n.Kind != yaml.MappingNode {
+    return nil
+  }
+
+  for i := 0; i+1 < len(n.Content); i += 2 {
+    if n.Content[i].Value == key {
+      return n.Content[i+1]
+    }
+  }
+
+  return nil
+}
+
+// resolveRuns completes each run with the template it extends and the
+// defaults of the job, so that the complete runs are checked against the
+// schema
+func (d *jobDoc) resolveRuns() error {
+  templates := make(map[string]*yaml.Node)
+  if list := mappingValue(d.root, "templates"); list != nil && list.Kind == yaml.SequenceNode {
+    for _, t := range list.Content {
+      name := mappingValue(t, "name")
+      if name == nil {
+        continue // reported by the schema
+      } else if _, ok := templates[name.Value]; ok {
+        return d.errorf(name, "Duplicate run template: %s", name.Value)
+      }
+      templates[name.Value] = t
+    }
+  }
+
+  runs := mappingValue(d.root, "runs")
+  if runs == nil || runs.Kind != yaml.SequenceNode {
+    return nil
+  }
+
+  defaults := mappingValue(d.root, "defaults")
+  for i, r := range runs.Content {
+    resolved, err := d.extend(r, templates, nil)
+    if err != nil {
+      return err
+    }
+
+    runs.Content[i] = d.inherit(resolved, defaults)
+  }
+
+  return nil
+}
+
+// extend returns the run with the attributes it does not set taken from the
+// template it extends, which may itself extend another template
+func (d *jobDoc) extend(r *yaml.Node, templates map[string]*yaml.Node, chain []string) (*yaml.Node, error) {
+  extends := mappingValue(r, "extends")
+  if extends == nil {
+    return r, nil
+  }
+
+  for _, name := range chain {
+    if name == extends.Value {
+      return nil, d.errorf(extends,
+        "Run template cycle: %s -> %s", strings.Join(chain, " -> "), extends.Value,
+      )
+    }
+  }
+
+  t, ok := templates[extends.Value]
+  if !ok {
+    return nil, d.errorf(extends, "Unknown run template: %s", extends.Value)
+  }
+
+  base, err := d.extend(t, templates, append(chain, extends.Value))
+  if err != nil {
+    return nil, err
+  }
+
+  // The run no longer extends a template once it has been resolved
+  var content []*yaml.Node
+  for i := 0; i+1 < len(r.Content); i += 2 {
+    if r.Content[i].Value != "extends" {
+      content = append(content, r.Content[i], r.Content[i+1])
+    }
+  }
+
+  extended := *r
+  extended.Content = content
+  d.files[&extended] = d.files[r]
+
+  return d.inherit(&extended, base), nil
+}
+
+// inherit returns a copy of the run with the attributes of base which it does
+// not set itself, except for the name
+func (d *jobDoc) inherit(r, base *yaml.Node) *yaml.Node {
+  if r.Kind != yaml.MappingNode || base == nil || base.Kind != yaml.MappingNode {
+    return r
+  }
+
+  merged := *r
+  merged.Content = append([]*yaml.Node{}, r.Content...)
+  d.files[&merged] = d.files[r]
+
+  for i := 0; i+1 < len(base.Content); i += 2 {
+    key := base.Content[i].Value
+    if key != "name" && key != "extends" && mappingValue(r, key) == nil {
+      merged.Content = append(merged.Content, base.Content[i], base.Content[i+1])
+    }
+  }
+
+  return &merged
+}
+
+// validate checks the merged job against the schema
+func (d *jobDoc) validate() error {
+  return validateNode(d.root, d.fileOf)
+}
+
+// bytes returns the merged job as yaml
+func (d *jobDoc) bytes() ([]byte, error) {
+  return yaml.Marshal(d.root)
+}
@@ -0,0 +1,347 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "os"
+  "fmt"
+  "reflect"
+  "strings"
+  "testing"
+  "io/ioutil"
+  "path/filepath"
+
+  "github.com/lancs-net/wayfinder/run"
+)
+
+func TestInputSources(t *testing.T) {
+  dir := writeTree(t, map[string]string{
+    "jobs/job.yaml": `
+include:
+  - common/inputs.yaml
+params:
+  - name: WORKERS
+    type: int
+    only: [1, 2]
+inputs:
+  - source: ./job.conf
+    destination: /etc/job.conf
+    template: true
+  - source: /etc/resolv.conf
+    destination: /etc/resolv.conf
+runs:
+  - name: run
+    image: alpine
+    cmd: cat /etc/job.conf
+`,
+    "jobs/job.conf": "workers {{.WORKERS}}\n",
+    "jobs/common/inputs.yaml": `
+inputs:
+  - source: included.conf
+    destination: /etc/included.conf
+    template: true
+`,
+    "jobs/common/included.conf": "included {{.WORKERS}}\n",
+  })
+  defer os.RemoveAll(dir)
+
+  // Parse the job by a relative path from another working directory
+  cwd, err := os.Getwd()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.Chdir(cwd)
+
+  err = os.Chdir(dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  job, _, err := ParseJob("jobs/job.yaml")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  err = os.Chdir(os.TempDir())
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  expected := []string{
+    filepath.Join(dir, "jobs/common/included.conf"),
+    filepath.Join(dir, "jobs/job.conf"),
+    "/etc/resolv.conf",
+  }
+
+  if len(job.Inputs) != len(expected) {
+    t.Fatalf("expected %d inputs, got %d", len(expected), len(job.Inputs))
+  }
+
+  for i, input := range job.Inputs {
+    if input.Source != expected[i] {
+      t.Errorf("expected source %s, got %s", expected[i], input.Source)
+    }
+  }
+
+  // Templated inputs render regardless of the working directory
+  params := []run.Param{{Name: "WORKERS", Type: "int", Value: "2"}}
+  out := filepath.Join(dir, "out")
+  for _, input := range job.Inputs[:2] {
+    err = input.Render(filepath.Join(out, filepath.Base(input.Source)), params)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  dat, err := ioutil.ReadFile(filepath.Join(out, "job.conf"))
+  if err != nil {
+    t.Fatal(err)
+  } else if string(dat) != "workers 2\n" {
+    t.Errorf("expected the rendered template, got %q", dat)
+  }
+}
+
+func TestCompose(t *testing.T) {
+  tests := []struct {
+    name    string
+    files   map[string]string
+    params  []string
+    runs    []string
+    sysctls map[string]string
+    err     string
+  }{{
+    name: "included lists are concatenated",
+    files: map[string]string{
+      "job.yaml": `include:
+  - a.yaml
+  - b.yaml
+params:
+  - {name: C, type: string, only: [c]}
+runs:
+  - {name: job, image: alpine}
+`,
+      "a.yaml": `params:
+  - {name: A, type: string, only: [a]}
+runs:
+  - {name: a, image: alpine}
+`,
+      "b.yaml": `params:
+  - {name: B, type: string, only: [b]}
+`,
+    },
+    params: []string{"A", "B", "C"},
+    runs:   []string{"a alpine 0 ", "job alpine 0 "},
+  }, {
+    name: "included mappings are merged",
+    files: map[string]string{
+      "job.yaml": `include: [a.yaml]
+host:
+  sysctls:
+    vm.swappiness: "1"
+    kernel.numa_balancing: "0"
+defaults:
+  cores: 4
+runs:
+  - {name: run, cmd: echo}
+`,
+      "a.yaml": `host:
+  sysctls:
+    vm.swappiness: "10"
+    kernel.randomize_va_space: "0"
+defaults:
+  image: alpine
+  cores: 2
+`,
+    },
+    runs: []string{"run alpine 4 echo"},
+    sysctls: map[string]string{
+      "vm.swappiness":             "1",
+      "kernel.numa_balancing":     "0",
+      "kernel.randomize_va_space": "0",
+    },
+  }, {
+    name: "nested includes are relative to the including file",
+    files: map[string]string{
+      "job.yaml": `include: [common/a.yaml]
+params:
+  - {name: J, type: string, only: [j]}
+runs:
+  - {name: run, image: alpine}
+`,
+      "common/a.yaml": `include: [b.yaml]
+params:
+  - {name: A, type: string, only: [a]}
+`,
+      "common/b.yaml": `include: [../shared/c.yaml]
+params:
+  - {name: B, type: string, only: [b]}
+`,
+      "shared/c.yaml": `params:
+  - {name: C, type: string, only: [c]}
+`,
+    },
+    params: []string{"C", "B", "A", "J"},
+    runs:   []string{"run alpine 0 "},
+  }, {
+    name: "include cycle",
+    files: map[string]string{
+      "job.yaml": `include: [common/a.yaml]
+runs:
+  - {name: run, image: alpine}
+`,
+      "common/a.yaml": `include: [../job.yaml]
+`,
+    },
+    err: "common/a.yaml:1:11: Include cycle: job.yaml -> common/a.yaml -> job.yaml",
+  }, {
+    name: "missing include",
+    files: map[string]string{
+      "job.yaml": `include: [missing.yaml]
+runs:
+  - {name: run, image: alpine}
+`,
+    },
+    err: "job.yaml:1:11: Could not include missing.yaml",
+  }, {
+    name: "mistake located in the included file",
+    files: map[string]string{
+      "job.yaml": `include: [a.yaml]
+runs:
+  - {name: run, image: alpine}
+`,
+      "a.yaml": `runs:
+  - name: a
+    image: alpine
+    core: 2
+`,
+    },
+    err: `a.yaml:4:5: runs[0].core: unknown field "core"`,
+  }, {
+    name: "defaults",
+    files: map[string]string{
+      "job.yaml": `defaults:
+  image: alpine
+  cores: 2
+runs:
+  - {name: default, cmd: echo}
+  - {name: own, image: busybox, cores: 1}
+`,
+    },
+    runs: []string{"default alpine 2 echo", "own busybox 1 "},
+  }, {
+    name: "templates extend templates",
+    files: map[string]string{
+      "job.yaml": `defaults:
+  image: alpine
+  cores: 1
+templates:
+  - {name: base, image: busybox, cores: 2, cmd: base}
+  - {name: build, extends: base, cmd: build}
+runs:
+  - {name: build, extends: build, cores: 4}
+  - {name: base, extends: base}
+  - {name: run, cmd: run}
+`,
+    },
+    runs: []string{"build busybox 4 build", "base busybox 2 base", "run alpine 1 run"},
+  }, {
+    name: "unknown template",
+    files: map[string]string{
+      "job.yaml": `runs:
+  - {name: run, image: alpine, extends: missing}
+`,
+    },
+    err: "job.yaml:2:41: Unknown run template: missing",
+  }, {
+    name: "template cycle",
+    files: map[string]string{
+      "job.yaml": `templates:
+  - {name: a, extends: b}
+  - {name: b, extends: a}
+runs:
+  - {name: run, image: alpine, extends: a}
+`,
+    },
+    err: "job.yaml:3:24: Run template cycle: a -> b -> a",
+  }, {
+    name: "duplicate template",
+    files: map[string]string{
+      "job.yaml": `templates:
+  - {name: a, image: alpine}
+  - {name: a, image: busybox}
+runs:
+  - {name: run, extends: a}
+`,
+    },
+    err: "job.yaml:3:12: Duplicate run template: a",
+  }}
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      dir := writeTree(t, test.files)
+      defer os.RemoveAll(dir)
+
+      job, _, err := ParseJob(filepath.Join(dir, "job.yaml"))
+      if len(test.err) > 0 {
+        if err == nil {
+          t.Fatalf("expected error %q", test.err)
+        } else if e := strings.ReplaceAll(err.Error(), dir+"/", ""); !strings.Contains(e, test.err) {
+          t.Fatalf("expected error %q, got %q", test.err, e)
+        }
+        return
+      } else if err != nil {
+        t.Fatal(err)
+      }
+
+      var params []string
+      for _, param := range job.Params {
+        params = append(params, param.Name)
+      }
+
+      if !reflect.DeepEqual(params, test.params) {
+        t.Errorf("expected params %v, got %v", test.params, params)
+      }
+
+      var runs []string
+      for _, r := range job.Runs {
+        runs = append(runs, fmt.Sprintf("%s %s %d %s", r.Name, r.Image, r.Cores, r.Cmd))
+      }
+
+      if !reflect.DeepEqual(runs, test.runs) {
+        t.Errorf("expected runs %q, got %q", test.runs, runs)
+      }
+
+      if test.sysctls != nil && !reflect.DeepEqual(job.Host.Sysctls, test.sysctls) {
+        t.Errorf("expected sysctls %v, got %v", test.sysctls, job.Host.Sysctls)
+      }
+    })
+  }
+}
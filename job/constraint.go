@@ -0,0 +1,128 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "fmt"
+)
+
+// constraint is a condition which every permutation of the parameters must
+// satisfy, e.g. `NUM_PARALLEL_CONNS <= WORKER_CONNECTIONS`
+type constraint struct {
+  expr     *Expr
+  excluded  int
+}
+
+// Exclusion is the number of permutations excluded by a constraint
+type Exclusion struct {
+  Constraint string
+  Excluded   int
+}
+
+// parseConstraints parses the constraints of the job, which may only reference
+// its parameters and derived parameters
+func (j *Job) parseConstraints() error {
+  j.constraints = nil
+  j.excluded = 0
+
+  names := make(map[string]bool)
+  for _, param := range j.AllParams() {
+    names[param.Name] = true
+  }
+  for _, d := range j.Derived {
+    names[d.Name] = true
+  }
+
+  for _, src := range j.Constraints {
+    expr, err := ParseExpr(src)
+    if err != nil {
+      return fmt.Errorf("Invalid constraint: %s", err)
+    }
+
+    for _, name := range expr.Params() {
+      if !names[name] {
+        return fmt.Errorf("Constraint %s references unknown parameter: %s", src, name)
+      }
+    }
+
+    j.constraints = append(j.constraints, &constraint{expr: expr})
+  }
+
+  return nil
+}
+
+// satisfies checks the permutation against every constraint and counts the
+// constraints it violates.  Constraints which reference a parameter that is
+// inactive in the permutation, because of its `when`, do not apply to it.
+func (j *Job) satisfies(params []TaskParam) (bool, error) {
+  lookup := func(name string) (string, bool) {
+    return paramValue(params, name)
+  }
+
+  ok := true
+  for _, c := range j.constraints {
+    res, err := c.expr.EvalBool(lookup)
+    if _, unknown := err.(errUnknownParam); unknown {
+      continue
+    } else if err != nil {
+      return false, fmt.Errorf("Could not evaluate constraint %s: %s", c.expr, err)
+    }
+
+    if !res {
+      c.excluded++
+      ok = false
+    }
+  }
+
+  if !ok {
+    j.excluded++
+  }
+
+  return ok, nil
+}
+
+// Excluded returns the number of permutations excluded by the constraints
+func (j *Job) Excluded() int {
+  return j.excluded
+}
+
+// Exclusions returns the number of permutations excluded by each constraint.
+// A permutation violating several constraints is counted by each of them.
+func (j *Job) Exclusions() []Exclusion {
+  var exclusions []Exclusion
+  for _, c := range j.constraints {
+    exclusions = append(exclusions, Exclusion{
+      Constraint: c.expr.String(),
+      Excluded:   c.excluded,
+    })
+  }
+  return exclusions
+}
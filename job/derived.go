@@ -0,0 +1,153 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "os"
+  "fmt"
+)
+
+// DerivedParam is a parameter whose value is computed from the other
+// parameters of a task, either by an expression or by a template such as
+// `${A}-${B}`.  Derived parameters are not swept and are not part of the
+// task's UUID.
+type DerivedParam struct {
+  Name     string `yaml:"name" schema:"required"`
+  Expr     string `yaml:"expr"`
+  Template string `yaml:"template"`
+  expr    *Expr
+}
+
+// references returns the names of the parameters which the derived parameter
+// uses
+func (d *DerivedParam) references() []string {
+  if d.expr != nil {
+    return d.expr.Params()
+  }
+
+  var names []string
+  os.Expand(d.Template, func(name string) string {
+    names = append(names, name)
+    return ""
+  })
+  return names
+}
+
+// parseDerived checks and parses the derived parameters of the job, which may
+// only use its parameters and the derived parameters declared before them
+func (j *Job) parseDerived() error {
+  names := make(map[string]bool)
+  for _, param := range j.AllParams() {
+    names[param.Name] = true
+  }
+
+  for i, d := range j.Derived {
+    if len(d.Name) == 0 {
+      return fmt.Errorf("Derived parameter is missing a name")
+    } else if names[d.Name] {
+      return fmt.Errorf("Derived parameter %s is already a parameter", d.Name)
+    }
+    names[d.Name] = true
+
+    if (len(d.Expr) > 0) == (len(d.Template) > 0) {
+      return fmt.Errorf("Derived parameter %s must have either expr or template", d.Name)
+    }
+
+    if len(d.Expr) > 0 {
+      expr, err := ParseExpr(d.Expr)
+      if err != nil {
+        return fmt.Errorf("Invalid derived parameter %s: %s", d.Name, err)
+      }
+      j.Derived[i].expr = expr
+    }
+
+    for _, name := range j.Derived[i].references() {
+      if !names[name] || name == d.Name {
+        return fmt.Errorf("Derived parameter %s references unknown parameter: %s", d.Name, name)
+      }
+    }
+  }
+
+  return nil
+}
+
+// derive computes the derived parameters of a permutation in order, so that
+// derived parameters may reference those declared before them.  A derived
+// parameter which references a parameter that is inactive in the permutation,
+// because of its `when`, is not set.  On error, the parameters derived so far
+// are returned.
+func (j *Job) derive(params []TaskParam) ([]TaskParam, error) {
+  var derived []TaskParam
+
+  lookup := func(name string) (string, bool) {
+    if value, ok := paramValue(params, name); ok {
+      return value, true
+    }
+    return paramValue(derived, name)
+  }
+
+  for _, d := range j.Derived {
+    var value string
+
+    if d.expr != nil {
+      v, err := d.expr.Eval(lookup)
+      if _, unknown := err.(errUnknownParam); unknown {
+        continue
+      } else if err != nil {
+        return derived, fmt.Errorf("Could not derive %s: %s", d.Name, err)
+      }
+      value = formatValue(v)
+
+    } else {
+      var err error
+      value = os.Expand(d.Template, func(name string) string {
+        v, ok := lookup(name)
+        if !ok && err == nil {
+          err = errUnknownParam{name}
+        }
+        return v
+      })
+      if _, unknown := err.(errUnknownParam); unknown {
+        continue
+      } else if err != nil {
+        return derived, fmt.Errorf("Could not derive %s: %s", d.Name, err)
+      }
+    }
+
+    derived = append(derived, TaskParam{
+      Name:  d.Name,
+      Type:  "derived",
+      Value: value,
+    })
+  }
+
+  return derived, nil
+}
@@ -0,0 +1,436 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "os"
+  "fmt"
+  "net"
+  "sort"
+  "path"
+  "os/exec"
+  "strings"
+  "strconv"
+
+  "golang.org/x/sys/unix"
+  "github.com/vishvananda/netlink"
+
+  "github.com/lancs-net/wayfinder/run"
+)
+
+// Check is the outcome of a single pre-flight check of the host
+type Check struct {
+  Name   string
+  Detail string
+  Err    error
+  Warn   bool // whether the failure does not prevent the job from running
+}
+
+// Failed returns whether the check would prevent the job from running
+func (c Check) Failed() bool {
+  return c.Err != nil && !c.Warn
+}
+
+// checks collects the outcome of each pre-flight check
+type checks []Check
+
+func (c *checks) pass(name, detail string) {
+  *c = append(*c, Check{Name: name, Detail: detail})
+}
+
+func (c *checks) fail(name string, err error) {
+  *c = append(*c, Check{Name: name, Err: err})
+}
+
+func (c *checks) warn(name string, err error) {
+  *c = append(*c, Check{Name: name, Err: err, Warn: true})
+}
+
+// Doctor checks whether the host provides everything which preparing the
+// environment, creating the bridge and starting the runs of a job rely on.
+// The job is optional, in which case only checks for the host are performed.
+func Doctor(j *Job, cfg *RuntimeConfig, minFree uint64) []Check {
+  var c checks
+
+  if os.Geteuid() == 0 {
+    c.pass("Root privileges", "")
+  } else {
+    c.fail("Root privileges", fmt.Errorf("wayfinder must be run as root"))
+  }
+
+  checkNamespaces(&c)
+  checkCgroups(&c, j)
+  checkCpus(&c, cfg.Cpus)
+
+  // Determine which networks the runs of the job need
+  bridged := j == nil
+  isolated := j == nil
+  var devices []string
+  if j != nil {
+    seen := make(map[string]bool)
+    for _, r := range j.Runs {
+      switch r.Network {
+      case "", run.NetworkBridged:
+        bridged = true
+      case run.NetworkIsolated:
+        isolated = true
+      }
+
+      for _, device := range r.Devices {
+        if !seen[device] {
+          seen[device] = true
+          devices = append(devices, device)
+        }
+      }
+    }
+  }
+
+  if bridged || isolated {
+    checkNetwork(&c, cfg, bridged)
+  }
+
+  for _, device := range devices {
+    checkDevice(&c, device)
+  }
+
+  var profile *HostProfile
+  if j != nil {
+    profile = j.Host
+  }
+  checkHostProfile(&c, profile.Merge(), cfg.Cpus)
+
+  if j != nil {
+    for _, param := range j.AllParams() {
+      if len(param.Host) == 0 {
+        continue
+      }
+
+      name := fmt.Sprintf("Host knob %s of %s", param.Host, param.Name)
+      if err := checkWritable(sysctlPath(param.Host)); err != nil {
+        c.fail(name, err)
+      } else {
+        c.pass(name, "")
+      }
+    }
+  }
+
+  checkDiskSpace(&c, cfg.WorkDir, minFree)
+
+  return c
+}
+
+// checkNamespaces checks the kernel supports the namespaces used by the runs
+func checkNamespaces(c *checks) {
+  for _, ns := range []string{"mnt", "uts", "ipc", "pid", "net"} {
+    name := fmt.Sprintf("%s namespace", ns)
+    if _, err := os.Stat(path.Join("/proc/self/ns", ns)); err != nil {
+      c.fail(name, fmt.Errorf("not supported by the kernel"))
+    } else {
+      c.pass(name, "")
+    }
+  }
+
+  if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+    c.fail("User namespaces", fmt.Errorf("not supported by the kernel"))
+    return
+  }
+
+  max := readSysValue("/proc/sys/user/max_user_namespaces")
+  if n, err := strconv.Atoi(max); err != nil {
+    c.warn("User namespaces", fmt.Errorf("could not read limit: %s", err))
+  } else if n == 0 {
+    c.fail("User namespaces", fmt.Errorf("disabled (user.max_user_namespaces=0)"))
+  } else {
+    c.pass("User namespaces", fmt.Sprintf("limit %d", n))
+  }
+}
+
+// checkCgroups checks the cgroup hierarchy and the controllers needed by the
+// runs of the job
+func checkCgroups(c *checks, j *Job) {
+  mode, err := run.CgroupMode()
+  if err != nil {
+    c.fail("cgroup hierarchy", err)
+    return
+  }
+  c.pass("cgroup hierarchy", mode)
+
+  controllers, err := run.CgroupControllers()
+  if err != nil {
+    c.fail("cgroup controllers", err)
+    return
+  }
+
+  required := run.RequiredCgroupControllers(mode)
+  if j != nil {
+    for _, r := range j.Runs {
+      for _, controller := range r.Resources.Controllers(mode) {
+        if !containsString(required, controller) {
+          required = append(required, controller)
+        }
+      }
+    }
+  }
+
+  for _, controller := range required {
+    name := fmt.Sprintf("cgroup controller %s", controller)
+    if controllers[controller] {
+      c.pass(name, "")
+    } else {
+      c.fail(name, fmt.Errorf("not enabled or not mounted"))
+    }
+  }
+}
+
+// containsString returns whether the string is in the list
+func containsString(list []string, s string) bool {
+  for _, item := range list {
+    if item == s {
+      return true
+    }
+  }
+  return false
+}
+
+// formatCpus returns a CPU list as a comma separated string
+func formatCpus(cpus []int) string {
+  return strings.Trim(strings.Join(strings.Fields(fmt.Sprint(cpus)), ","), "[]")
+}
+
+// checkCpus checks that the CPUs of the job are online and can be assigned to
+// the runs' cpusets
+func checkCpus(c *checks, cpus []int) {
+  if len(cpus) == 0 {
+    c.fail("CPU sets", fmt.Errorf("no CPUs selected"))
+    return
+  }
+
+  online, err := run.ParseCpuList(readSysValue("/sys/devices/system/cpu/online"))
+  if err != nil {
+    c.fail("CPUs online", err)
+  } else {
+    c.checkCpuSubset("CPUs online", cpus, online, "offline")
+  }
+
+  effective, err := run.CpusetEffective()
+  if err != nil {
+    c.fail("CPUs in root cpuset", err)
+  } else {
+    c.checkCpuSubset("CPUs in root cpuset", cpus, effective, "unavailable")
+  }
+
+  exclusive, err := run.CpusetExclusive()
+  if err != nil {
+    c.warn("CPUs not claimed by other cpusets", err)
+  } else {
+    var claims []string
+    for cgroup, claimed := range exclusive {
+      if overlap := intersectCpus(cpus, claimed); len(overlap) > 0 {
+        claims = append(claims, fmt.Sprintf("%s by %s", formatCpus(overlap), cgroup))
+      }
+    }
+    sort.Strings(claims)
+
+    if len(claims) > 0 {
+      c.fail("CPUs not claimed by other cpusets",
+        fmt.Errorf("claimed exclusively: %s", strings.Join(claims, "; ")))
+    } else {
+      c.pass("CPUs not claimed by other cpusets", "")
+    }
+  }
+
+  // CPUs isolated with isolcpus= are usable, but are not load balanced
+  isolated, err := run.ParseCpuList(readSysValue("/sys/devices/system/cpu/isolated"))
+  if err == nil {
+    if overlap := intersectCpus(cpus, isolated); len(overlap) > 0 {
+      c.warn("CPUs not isolated by the kernel",
+        fmt.Errorf("%s isolated, runs with multiple cores are not balanced", formatCpus(overlap)))
+    } else {
+      c.pass("CPUs not isolated by the kernel", "")
+    }
+  }
+}
+
+// checkCpuSubset checks that all CPUs are contained in the set
+func (c *checks) checkCpuSubset(name string, cpus, set []int, reason string) {
+  var missing []int
+  for _, cpu := range cpus {
+    if len(intersectCpus([]int{cpu}, set)) == 0 {
+      missing = append(missing, cpu)
+    }
+  }
+
+  if len(missing) > 0 {
+    c.fail(name, fmt.Errorf("%s %s", formatCpus(missing), reason))
+  } else {
+    c.pass(name, formatCpus(cpus))
+  }
+}
+
+// intersectCpus returns the CPUs which are in both lists
+func intersectCpus(a, b []int) []int {
+  var cpus []int
+  for _, x := range a {
+    for _, y := range b {
+      if x == y {
+        cpus = append(cpus, x)
+        break
+      }
+    }
+  }
+  return cpus
+}
+
+// checkNetwork checks that the bridge can be created and, if runs are bridged,
+// NAT'd to the host interface
+func checkNetwork(c *checks, cfg *RuntimeConfig, bridged bool) {
+  if _, err := exec.LookPath("iptables"); err != nil {
+    c.fail("iptables", err)
+  } else {
+    c.pass("iptables", "")
+  }
+
+  if !bridged {
+    return
+  }
+
+  name := fmt.Sprintf("Host interface %s", cfg.BridgeIface)
+  if link, err := netlink.LinkByName(cfg.BridgeIface); err != nil {
+    c.fail(name, err)
+  } else if link.Attrs().OperState != netlink.OperUp {
+    c.warn(name, fmt.Errorf("link is %s", link.Attrs().OperState))
+  } else {
+    c.pass(name, "")
+  }
+
+  name = fmt.Sprintf("Bridge %s", cfg.BridgeName)
+  if _, err := net.InterfaceByName(cfg.BridgeName); err != nil {
+    c.pass(name, "name is free")
+  } else if link, err := netlink.LinkByName(cfg.BridgeName); err != nil {
+    c.fail(name, err)
+  } else if link.Type() != "bridge" {
+    c.fail(name, fmt.Errorf("interface exists and is a %s", link.Type()))
+  } else {
+    c.warn(name, fmt.Errorf("bridge exists and will be re-used"))
+  }
+}
+
+// checkDevice checks that a device requested by a run exists on the host
+func checkDevice(c *checks, device string) {
+  name := fmt.Sprintf("Device %s", device)
+
+  fi, err := os.Stat(device)
+  if err != nil {
+    c.fail(name, err)
+  } else if fi.Mode()&os.ModeCharDevice == 0 {
+    c.fail(name, fmt.Errorf("not a character device"))
+  } else {
+    c.pass(name, "")
+  }
+}
+
+// checkWritable checks that the procfs or sysfs entry can be written
+func checkWritable(p string) error {
+  if _, err := os.Stat(p); err != nil {
+    return err
+  }
+
+  if err := unix.Access(p, unix.W_OK); err != nil {
+    return fmt.Errorf("%s: not writable: %s", p, err)
+  }
+
+  return nil
+}
+
+// checkHostProfile checks that the entries of the host profile can be set.
+// Per-CPU entries are checked once for all CPUs.
+func checkHostProfile(c *checks, profile *HostProfile, cpus []int) {
+  for _, name := range sortedKeys(profile.Sysctls) {
+    check := fmt.Sprintf("Sysctl %s", name)
+    if err := checkWritable(sysctlPath(name)); err != nil {
+      c.fail(check, err)
+    } else {
+      c.pass(check, "")
+    }
+  }
+
+  for _, p := range sortedKeys(profile.Sysfs) {
+    if err := checkWritable(p); err != nil {
+      c.warn(p, err)
+    } else {
+      c.pass(p, "")
+    }
+  }
+
+  for _, tmpl := range sortedKeys(profile.Cpus) {
+    var missing []int
+    var err error
+    for _, cpu := range cpus {
+      p := strings.ReplaceAll(tmpl, "{cpu}", strconv.Itoa(cpu))
+      if e := checkWritable(p); e != nil {
+        missing = append(missing, cpu)
+        err = e
+      }
+    }
+
+    if len(missing) > 0 {
+      c.warn(tmpl, fmt.Errorf("CPUs %s: %s", formatCpus(missing), err))
+    } else {
+      c.pass(tmpl, "")
+    }
+  }
+}
+
+// checkDiskSpace checks the free space of the filesystem of the workdir
+func checkDiskSpace(c *checks, workDir string, minFree uint64) {
+  // The workdir is created by the job, so check its closest existing parent
+  dir := workDir
+  for {
+    if _, err := os.Stat(dir); err == nil || dir == "/" || dir == "." {
+      break
+    }
+    dir = path.Dir(dir)
+  }
+
+  var st unix.Statfs_t
+  if err := unix.Statfs(dir, &st); err != nil {
+    c.fail("Disk space", err)
+    return
+  }
+
+  free := st.Bavail * uint64(st.Bsize)
+  detail := fmt.Sprintf("%.1f GiB free in %s", float64(free)/(1<<30), workDir)
+  if free < minFree {
+    c.fail("Disk space", fmt.Errorf("%s, need %.1f GiB", detail, float64(minFree)/(1<<30)))
+  } else {
+    c.pass("Disk space", detail)
+  }
+}
@@ -0,0 +1,516 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "fmt"
+  "math"
+  "strconv"
+  "strings"
+  "unicode"
+)
+
+// Expressions are used to constrain and derive parameters.  They support
+// numbers, quoted strings, `true` and `false`, references to parameters by
+// name, arithmetic (`+ - * / %`), comparisons (`== != < <= > >=`) and logic
+// (`&& || !`, or `and or not`).  Parameter values which look like numbers are
+// compared as numbers, `true` and `false` are booleans, and other values are
+// strings.
+
+// errUnknownParam is returned when an expression references a parameter which
+// the task does not have
+type errUnknownParam struct {
+  name string
+}
+
+func (e errUnknownParam) Error() string {
+  return fmt.Sprintf("Unknown parameter: %s", e.name)
+}
+
+// exprNode is a node of a parsed expression
+type exprNode interface {
+  eval(lookup func(string) (string, bool)) (interface{}, error)
+}
+
+// Expr is a parsed expression
+type Expr struct {
+  src    string
+  root   exprNode
+  params []string
+}
+
+// ParseExpr parses an expression
+func ParseExpr(src string) (*Expr, error) {
+  tokens, err := tokenize(src)
+  if err != nil {
+    return nil, fmt.Errorf("Invalid expression %q: %s", src, err)
+  }
+
+  p := &exprParser{tokens: tokens}
+  root, err := p.parseOr()
+  if err == nil && p.pos < len(p.tokens) {
+    err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+  }
+  if err != nil {
+    return nil, fmt.Errorf("Invalid expression %q: %s", src, err)
+  }
+
+  return &Expr{src: src, root: root, params: p.params}, nil
+}
+
+func (e *Expr) String() string {
+  return e.src
+}
+
+// Params returns the names of the parameters which the expression references
+func (e *Expr) Params() []string {
+  return e.params
+}
+
+// Eval evaluates the expression with the parameter values of the lookup
+func (e *Expr) Eval(lookup func(string) (string, bool)) (interface{}, error) {
+  return e.root.eval(lookup)
+}
+
+// EvalBool evaluates the expression, which must result in a boolean
+func (e *Expr) EvalBool(lookup func(string) (string, bool)) (bool, error) {
+  v, err := e.Eval(lookup)
+  if err != nil {
+    return false, err
+  }
+
+  b, ok := v.(bool)
+  if !ok {
+    return false, fmt.Errorf("Expression is not a condition: %s", e.src)
+  }
+
+  return b, nil
+}
+
+// formatValue returns the string form of an evaluated value
+func formatValue(v interface{}) string {
+  switch val := v.(type) {
+  case float64:
+    return strconv.FormatFloat(val, 'f', -1, 64)
+  case bool:
+    return strconv.FormatBool(val)
+  }
+  return fmt.Sprint(v)
+}
+
+// exprValue converts a parameter value into a number if it looks like one, or
+// into a boolean if it is `true` or `false`.  Only finite numbers are numeric,
+// so that values such as `inf` or `NaN` remain strings.
+func exprValue(s string) interface{} {
+  if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+    return f
+  }
+  switch s {
+  case "true":
+    return true
+  case "false":
+    return false
+  }
+  return s
+}
+
+type exprToken struct {
+  kind string // num, str, ident or op
+  text string
+}
+
+// exprOps are the operators, longest first
+var exprOps = []string{
+  "&&", "||", "==", "!=", "<=", ">=",
+  "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", ",",
+}
+
+func tokenize(src string) ([]exprToken, error) {
+  var tokens []exprToken
+
+  for i := 0; i < len(src); {
+    c := rune(src[i])
+    switch {
+    case unicode.IsSpace(c):
+      i++
+
+    case unicode.IsDigit(c) || (c == '.' && i+1 < len(src) && unicode.IsDigit(rune(src[i+1]))):
+      j := i
+      for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.' || src[j] == 'e' ||
+        ((src[j] == '-' || src[j] == '+') && j > i && src[j-1] == 'e')) {
+        j++
+      }
+      tokens = append(tokens, exprToken{"num", src[i:j]})
+      i = j
+
+    case c == '"' || c == '\'':
+      j := strings.IndexRune(src[i+1:], c)
+      if j < 0 {
+        return nil, fmt.Errorf("unterminated string")
+      }
+      tokens = append(tokens, exprToken{"str", src[i+1 : i+1+j]})
+      i += j + 2
+
+    case c == '_' || unicode.IsLetter(c):
+      j := i
+      for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+        j++
+      }
+      word := src[i:j]
+      switch word {
+      case "and":
+        tokens = append(tokens, exprToken{"op", "&&"})
+      case "or":
+        tokens = append(tokens, exprToken{"op", "||"})
+      case "not":
+        tokens = append(tokens, exprToken{"op", "!"})
+      default:
+        tokens = append(tokens, exprToken{"ident", word})
+      }
+      i = j
+
+    default:
+      found := false
+      for _, op := range exprOps {
+        if strings.HasPrefix(src[i:], op) {
+          tokens = append(tokens, exprToken{"op", op})
+          i += len(op)
+          found = true
+          break
+        }
+      }
+      if !found {
+        return nil, fmt.Errorf("unexpected character %q", c)
+      }
+    }
+  }
+
+  return tokens, nil
+}
+
+type exprParser struct {
+  tokens []exprToken
+  pos    int
+  params []string
+}
+
+// accept consumes the next token if it is one of the operators
+func (p *exprParser) accept(ops ...string) (string, bool) {
+  if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != "op" {
+    return "", false
+  }
+  for _, op := range ops {
+    if p.tokens[p.pos].text == op {
+      p.pos++
+      return op, true
+    }
+  }
+  return "", false
+}
+
+// parseBinary parses left-associative operators of the same precedence
+func (p *exprParser) parseBinary(next func() (exprNode, error), ops ...string) (exprNode, error) {
+  left, err := next()
+  if err != nil {
+    return nil, err
+  }
+
+  for {
+    op, ok := p.accept(ops...)
+    if !ok {
+      return left, nil
+    }
+
+    right, err := next()
+    if err != nil {
+      return nil, err
+    }
+
+    left = &binaryNode{op: op, left: left, right: right}
+  }
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+  return p.parseBinary(p.parseAnd, "||")
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+  return p.parseBinary(p.parseNot, "&&")
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+  if _, ok := p.accept("!"); ok {
+    operand, err := p.parseNot()
+    if err != nil {
+      return nil, err
+    }
+    return &unaryNode{op: "!", operand: operand}, nil
+  }
+
+  return p.parseCmp()
+}
+
+func (p *exprParser) parseCmp() (exprNode, error) {
+  left, err := p.parseSum()
+  if err != nil {
+    return nil, err
+  }
+
+  op, ok := p.accept("==", "!=", "<=", ">=", "<", ">")
+  if !ok {
+    return left, nil
+  }
+
+  right, err := p.parseSum()
+  if err != nil {
+    return nil, err
+  }
+
+  return &binaryNode{op: op, left: left, right: right}, nil
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+  return p.parseBinary(p.parseProduct, "+", "-")
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+  return p.parseBinary(p.parseUnary, "*", "/", "%")
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+  if _, ok := p.accept("-"); ok {
+    operand, err := p.parseUnary()
+    if err != nil {
+      return nil, err
+    }
+    return &unaryNode{op: "-", operand: operand}, nil
+  }
+
+  return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+  if p.pos >= len(p.tokens) {
+    return nil, fmt.Errorf("unexpected end")
+  }
+
+  tok := p.tokens[p.pos]
+  p.pos++
+
+  switch tok.kind {
+  case "num":
+    f, err := strconv.ParseFloat(tok.text, 64)
+    if err != nil {
+      return nil, fmt.Errorf("invalid number %q", tok.text)
+    }
+    return &literalNode{f}, nil
+
+  case "str":
+    return &literalNode{tok.text}, nil
+
+  case "ident":
+    switch tok.text {
+    case "true":
+      return &literalNode{true}, nil
+    case "false":
+      return &literalNode{false}, nil
+    }
+    for _, name := range p.params {
+      if name == tok.text {
+        return &paramNode{tok.text}, nil
+      }
+    }
+    p.params = append(p.params, tok.text)
+    return &paramNode{tok.text}, nil
+
+  case "op":
+    if tok.text == "(" {
+      node, err := p.parseOr()
+      if err != nil {
+        return nil, err
+      }
+      if _, ok := p.accept(")"); !ok {
+        return nil, fmt.Errorf("missing )")
+      }
+      return node, nil
+    }
+  }
+
+  return nil, fmt.Errorf("unexpected %q", tok.text)
+}
+
+type literalNode struct {
+  value interface{}
+}
+
+func (n *literalNode) eval(lookup func(string) (string, bool)) (interface{}, error) {
+  return n.value, nil
+}
+
+type paramNode struct {
+  name string
+}
+
+func (n *paramNode) eval(lookup func(string) (string, bool)) (interface{}, error) {
+  v, ok := lookup(n.name)
+  if !ok {
+    return nil, errUnknownParam{n.name}
+  }
+  return exprValue(v), nil
+}
+
+type unaryNode struct {
+  op      string
+  operand exprNode
+}
+
+func (n *unaryNode) eval(lookup func(string) (string, bool)) (interface{}, error) {
+  v, err := n.operand.eval(lookup)
+  if err != nil {
+    return nil, err
+  }
+
+  switch n.op {
+  case "!":
+    if b, ok := v.(bool); ok {
+      return !b, nil
+    }
+  case "-":
+    if f, ok := v.(float64); ok {
+      return -f, nil
+    }
+  }
+
+  return nil, fmt.Errorf("Cannot apply %s to %q", n.op, formatValue(v))
+}
+
+type binaryNode struct {
+  op    string
+  left  exprNode
+  right exprNode
+}
+
+func (n *binaryNode) eval(lookup func(string) (string, bool)) (interface{}, error) {
+  l, err := n.left.eval(lookup)
+  if err != nil {
+    return nil, err
+  }
+
+  // Short-circuit logic so that conditions can guard each other
+  if n.op == "&&" || n.op == "||" {
+    lb, ok := l.(bool)
+    if !ok {
+      return nil, fmt.Errorf("Cannot apply %s to %q", n.op, formatValue(l))
+    }
+    if (n.op == "&&" && !lb) || (n.op == "||" && lb) {
+      return lb, nil
+    }
+  }
+
+  r, err := n.right.eval(lookup)
+  if err != nil {
+    return nil, err
+  }
+
+  lf, lnum := l.(float64)
+  rf, rnum := r.(float64)
+
+  switch n.op {
+  case "&&", "||":
+    if rb, ok := r.(bool); ok {
+      return rb, nil
+    }
+
+  case "==":
+    return formatValue(l) == formatValue(r), nil
+  case "!=":
+    return formatValue(l) != formatValue(r), nil
+
+  case "<", "<=", ">", ">=":
+    var c int
+    if lnum && rnum {
+      c = compareFloat(lf, rf)
+    } else {
+      c = strings.Compare(formatValue(l), formatValue(r))
+    }
+    switch n.op {
+    case "<":
+      return c < 0, nil
+    case "<=":
+      return c <= 0, nil
+    case ">":
+      return c > 0, nil
+    default:
+      return c >= 0, nil
+    }
+
+  case "+":
+    if lnum && rnum {
+      return lf + rf, nil
+    }
+    // Concatenate strings
+    return formatValue(l) + formatValue(r), nil
+
+  case "-", "*", "/", "%":
+    if !lnum || !rnum {
+      break
+    }
+    switch n.op {
+    case "-":
+      return lf - rf, nil
+    case "*":
+      return lf * rf, nil
+    case "/":
+      if rf == 0 {
+        return nil, fmt.Errorf("Division by zero")
+      }
+      return lf / rf, nil
+    default:
+      if rf == 0 {
+        return nil, fmt.Errorf("Division by zero")
+      }
+      return math.Mod(lf, rf), nil
+    }
+  }
+
+  return nil, fmt.Errorf(
+    "Cannot apply %s to %q and %q", n.op, formatValue(l), formatValue(r),
+  )
+}
+
+func compareFloat(a, b float64) int {
+  if a < b {
+    return -1
+  } else if a > b {
+    return 1
+  }
+  return 0
+}
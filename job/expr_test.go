@@ -0,0 +1,231 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "reflect"
+  "strings"
+  "testing"
+)
+
+func TestExprEval(t *testing.T) {
+  values := map[string]string{
+    "A":     "4",
+    "B":     "10",
+    "S":     "abc",
+    "F":     "2.5",
+    "NINE":  "9",
+    "T":     "true",
+    "NOT_T": "false",
+    "INF":   "inf",
+    "NAN":   "NaN",
+    "INFTY": "Infinity",
+  }
+
+  lookup := func(name string) (string, bool) {
+    v, ok := values[name]
+    return v, ok
+  }
+
+  tests := []struct {
+    src      string
+    expected string
+  }{
+    // Precedence
+    {"1 + 2 * 3", "7"},
+    {"(1 + 2) * 3", "9"},
+    {"10 - 4 - 3", "3"},
+    {"12 / 3 / 2", "2"},
+    {"-A + 1", "-3"},
+    {"B % A", "2"},
+    {"A * 2 == B - 2", "true"},
+    {"true || false && false", "true"},
+    {"!false && false", "false"},
+    {"not A == 4 or B > 5", "true"},
+    {"A < B and B < 20", "true"},
+
+    // Parameters which look like numbers are compared as numbers
+    {"NINE < B", "true"},
+    {"F > 2", "true"},
+    {"A == 4.0", "true"},
+    {"A == '4'", "true"},
+    {"T && !NOT_T", "true"},
+    {`T == "true"`, "true"},
+
+    // Only finite numbers are numeric
+    {`INF == "inf"`, "true"},
+    {`NAN == "NaN"`, "true"},
+    {`INFTY == "Infinity"`, "true"},
+    {`INF + 1`, "inf1"},
+    {`NAN == NAN`, "true"},
+
+    // Strings are compared as strings
+    {`"9" < "10"`, "false"},
+    {`S == "abc"`, "true"},
+    {`S < 'abd'`, "true"},
+    {`S + "d"`, "abcd"},
+    {`S + A`, "abc4"},
+
+    // Logic short-circuits
+    {"false && UNKNOWN", "false"},
+    {"true || UNKNOWN", "true"},
+  }
+
+  for _, test := range tests {
+    expr, err := ParseExpr(test.src)
+    if err != nil {
+      t.Errorf("%s: %s", test.src, err)
+      continue
+    }
+
+    v, err := expr.Eval(lookup)
+    if err != nil {
+      t.Errorf("%s: %s", test.src, err)
+    } else if formatValue(v) != test.expected {
+      t.Errorf("%s: expected %s, got %s", test.src, test.expected, formatValue(v))
+    }
+  }
+}
+
+func TestExprErrors(t *testing.T) {
+  lookup := func(name string) (string, bool) {
+    if name == "S" {
+      return "abc", true
+    }
+    return "", false
+  }
+
+  // Errors when parsing
+  for _, src := range []string{
+    "", "1 +", "(1", "1)", "1 2", `"open`, "A # B", "A = 1", "*",
+  } {
+    if _, err := ParseExpr(src); err == nil {
+      t.Errorf("%q: expected a parse error", src)
+    }
+  }
+
+  // Errors when evaluating
+  tests := []struct {
+    src string
+    err string
+  }{
+    {"1 / 0", "Division by zero"},
+    {"1 % 0", "Division by zero"},
+    {"S - 1", "Cannot apply -"},
+    {"-S", "Cannot apply -"},
+    {"!1", "Cannot apply !"},
+    {"1 && true", "Cannot apply &&"},
+    {"UNKNOWN > 1", "Unknown parameter: UNKNOWN"},
+  }
+
+  for _, test := range tests {
+    expr, err := ParseExpr(test.src)
+    if err != nil {
+      t.Errorf("%s: %s", test.src, err)
+      continue
+    }
+
+    _, err = expr.Eval(lookup)
+    if err == nil || !strings.Contains(err.Error(), test.err) {
+      t.Errorf("%s: expected error %q, got %v", test.src, test.err, err)
+    }
+  }
+
+  // Unknown parameters are distinguished from other errors
+  expr, _ := ParseExpr("UNKNOWN > 1")
+  if _, err := expr.Eval(lookup); err != (errUnknownParam{"UNKNOWN"}) {
+    t.Errorf("expected an unknown parameter, got %v", err)
+  }
+
+  expr, _ = ParseExpr("1 + 1")
+  if _, err := expr.EvalBool(lookup); err == nil {
+    t.Error("expected a condition error for 1 + 1")
+  }
+}
+
+func TestExprParams(t *testing.T) {
+  expr, err := ParseExpr(`A < B && (A + C == 3 || not D) && "E" == 'F' && true`)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  expected := []string{"A", "B", "C", "D"}
+  if !reflect.DeepEqual(expr.Params(), expected) {
+    t.Errorf("expected %v, got %v", expected, expr.Params())
+  }
+}
+
+func TestConstraints(t *testing.T) {
+  tests := []struct {
+    constraints []string
+    tasks       int
+    excluded    int
+    err         string
+  }{
+    {nil, 12, 0, ""},
+    {[]string{"A < B"}, 3, 9, ""},
+    {[]string{"A <= B", "A + B != 2"}, 5, 7, ""},
+    {[]string{"C == 1"}, 9, 3, ""},   // C is only active when A is 2
+    {[]string{"SUM < 3"}, 7, 5, ""},  // derived parameters are known
+    {[]string{"A < BB"}, 0, 0, "unknown parameter: BB"},
+    {[]string{"A <"}, 0, 0, "Invalid constraint"},
+  }
+
+  for _, test := range tests {
+    j := &Job{
+      Params: []JobParam{
+        {Name: "A", Type: "int", Min: "0", Max: "2", Params: []JobParam{
+          {Name: "C", Type: "int", Only: []string{"0", "1"}, When: "A == 2"},
+        }},
+        {Name: "B", Type: "int", Min: "0", Max: "2"},
+      },
+      Derived:     []DerivedParam{{Name: "SUM", Expr: "A + B"}},
+      Constraints: test.constraints,
+    }
+
+    tasks, err := j.tasks()
+    if len(test.err) > 0 {
+      if err == nil || !strings.Contains(err.Error(), test.err) {
+        t.Errorf("%v: expected error %q, got %v", test.constraints, test.err, err)
+      }
+      continue
+    } else if err != nil {
+      t.Errorf("%v: %s", test.constraints, err)
+      continue
+    }
+
+    if len(tasks) != test.tasks || j.Excluded() != test.excluded {
+      t.Errorf("%v: expected %d tasks and %d excluded, got %d and %d",
+        test.constraints, test.tasks, test.excluded, len(tasks), j.Excluded(),
+      )
+    }
+  }
+}
@@ -0,0 +1,179 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "fmt"
+  "path"
+  "sort"
+  "strings"
+  "io/ioutil"
+  "encoding/json"
+)
+
+// HostProfile describes the state the host should be in during a job.  Sysctls
+// are given by their dotted name (or a path), sysfs entries by their path and
+// per-CPU entries by a path template where `{cpu}` is replaced by the ID of
+// each CPU used by the job.
+type HostProfile struct {
+  Sysctls map[string]string `yaml:"sysctls"`
+  Sysfs   map[string]string `yaml:"sysfs"`
+  Cpus    map[string]string `yaml:"cpus"`
+}
+
+// HostSetting is a single procfs or sysfs entry of a host profile
+type HostSetting struct {
+  Path     string `json:"path"`
+  Value    string `json:"value"`
+  Original string `json:"original,omitempty"`
+  Required bool   `json:"required"`
+}
+
+// DefaultHostProfile is the base of every job's host profile
+var DefaultHostProfile = HostProfile{
+  Sysctls: map[string]string{
+    "fs.file-max":                      "20000",
+    "net.core.somaxconn":               "1024",
+    "net.ipv4.ip_forward":              "1",
+    "net.ipv4.ip_local_port_range":     "1024   60999",
+    "net.ipv4.tcp_keepalive_time":      "60",
+    "net.ipv4.tcp_keepalive_intvl":     "60",
+    "kernel.randomize_va_space":        "0", // Disable ASLR
+    "kernel.unprivileged_userns_clone": "1", // Allow rootless containers
+  },
+  Sysfs: map[string]string{
+    "/sys/devices/system/cpu/intel_pstate/no_turbo": "1",
+  },
+  Cpus: map[string]string{
+    "/sys/devices/system/cpu/cpu{cpu}/cpufreq/scaling_governor": "performance",
+  },
+}
+
+// Merge returns the profile with its entries set over those of the default
+// profile, key by key.  Entries set to an empty value are not applied, which
+// allows a job to opt out of a default.
+func (h *HostProfile) Merge() *HostProfile {
+  merge := func(base, over map[string]string) map[string]string {
+    merged := make(map[string]string)
+    for k, v := range base {
+      merged[k] = v
+    }
+    for k, v := range over {
+      if len(v) == 0 {
+        delete(merged, k)
+      } else {
+        merged[k] = v
+      }
+    }
+    return merged
+  }
+
+  if h == nil {
+    h = &HostProfile{}
+  }
+
+  return &HostProfile{
+    Sysctls: merge(DefaultHostProfile.Sysctls, h.Sysctls),
+    Sysfs:   merge(DefaultHostProfile.Sysfs, h.Sysfs),
+    Cpus:    merge(DefaultHostProfile.Cpus, h.Cpus),
+  }
+}
+
+// sysctlPath returns the procfs path of a sysctl
+func sysctlPath(name string) string {
+  if strings.HasPrefix(name, "/") {
+    return name
+  }
+
+  return path.Join("/proc/sys", strings.ReplaceAll(name, ".", "/"))
+}
+
+// sortedKeys returns the keys of the map in order
+func sortedKeys(m map[string]string) []string {
+  var keys []string
+  for key := range m {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+// Settings resolves the profile into the list of entries to set for the given
+// CPUs.  Sysctls are required whereas sysfs and per-CPU entries depend on the
+// hardware and are allowed to fail.
+func (h *HostProfile) Settings(cpus []int) []HostSetting {
+  var settings []HostSetting
+
+  for _, name := range sortedKeys(h.Sysctls) {
+    settings = append(settings, HostSetting{
+      Path:     sysctlPath(name),
+      Value:    h.Sysctls[name],
+      Required: true,
+    })
+  }
+
+  for _, p := range sortedKeys(h.Sysfs) {
+    settings = append(settings, HostSetting{
+      Path:  p,
+      Value: h.Sysfs[p],
+    })
+  }
+
+  for _, tmpl := range sortedKeys(h.Cpus) {
+    for _, cpu := range cpus {
+      settings = append(settings, HostSetting{
+        Path:  strings.ReplaceAll(tmpl, "{cpu}", fmt.Sprintf("%d", cpu)),
+        Value: h.Cpus[tmpl],
+      })
+    }
+  }
+
+  return settings
+}
+
+// writeHostSettings records the applied settings of the host in a file
+func writeHostSettings(file string, settings []HostSetting) error {
+  items := procfs.snapshot()
+  for i, setting := range settings {
+    for _, item := range items {
+      if item.Path == setting.Path {
+        settings[i].Original = item.Original
+      }
+    }
+  }
+
+  b, err := json.MarshalIndent(settings, "", "\t")
+  if err != nil {
+    return fmt.Errorf("Could not marshal JSON of host settings: %s", err)
+  }
+
+  return ioutil.WriteFile(file, b, 0644)
+}
@@ -36,9 +36,13 @@ import (
   "math"
   "time"
   "sync"
+  "sync/atomic"
   "path"
+  "regexp"
   "strconv"
+  "strings"
   "io/ioutil"
+  "crypto/sha256"
   "encoding/json"
 
   "gopkg.in/yaml.v2"
@@ -49,29 +53,76 @@ import (
 )
 
 type JobParam struct {
-  Name      string   `yaml:"name"`
-  Type      string   `yaml:"type"`
-  Default   string   `yaml:"default"`
-  Only    []string   `yaml:"only"`
-  Min       string   `yaml:"min"`
-  Max       string   `yaml:"max"`
-  Step      string   `yaml:"step"`
-  StepMode  string   `yaml:"step_mode"`
-  Params  []JobParam `yaml:"params"`
-  When      string   `yaml:"when"`
-  Comp      string
+  Name        string   `yaml:"name"`
+  Type        string   `yaml:"type" schema:"enum=string|int|integer|float|bool|boolean|size"`
+  Default     string   `yaml:"default"`
+  Only      []string   `yaml:"only"`
+  Min         string   `yaml:"min"`
+  Max         string   `yaml:"max"`
+  Step        string   `yaml:"step"`
+  StepMode    string   `yaml:"step_mode" schema:"enum=increment|multiply|power|linspace|log"`
+  Count       string   `yaml:"count"`
+  TrueValue   string   `yaml:"true_value"`
+  FalseValue  string   `yaml:"false_value"`
+  Params    []JobParam `yaml:"params"`
+  When        string   `yaml:"when"`
+  Host        string   `yaml:"host"`
+  Zip       []JobParam `yaml:"zip"`
+  Kconfig    *KconfigSource `yaml:"kconfig"`
+}
+
+// members returns the parameters of a zip group, or the parameter itself
+func (p *JobParam) members() []*JobParam {
+  if len(p.Zip) == 0 {
+    return []*JobParam{p}
+  }
+
+  var members []*JobParam
+  for i := range p.Zip {
+    members = append(members, &p.Zip[i])
+  }
+  return members
+}
+
+// label returns the name of the parameter or the names of a zip group
+func (p *JobParam) label() string {
+  if len(p.Zip) == 0 {
+    return p.Name
+  }
+
+  var names []string
+  for _, m := range p.members() {
+    names = append(names, m.Name)
+  }
+  return fmt.Sprintf("zip(%s)", strings.Join(names, ", "))
 }
 
 type Job struct {
   Params        []JobParam   `yaml:"params"`
+  Derived       []DerivedParam `yaml:"derived"`
+  Constraints   []string     `yaml:"constraints"`
   Inputs        []run.Input  `yaml:"inputs"`
   Outputs       []run.Output `yaml:"outputs"`
   Runs          []run.Run    `yaml:"runs"`
+  Include       []string     `yaml:"include"`   // merged when parsed
+  Defaults     *RunDefaults  `yaml:"defaults"`  // applied to runs when parsed
+  Templates     []run.Run    `yaml:"templates"` // extended by runs when parsed
+  Host         *HostProfile  `yaml:"host"`
   waitList     *List
   scheduleGrace int
   dryRun        bool
   bridge       *run.Bridge
+  isolated     *isolatedBridges
+  knobs        *hostKnobs
   maxRetries    int
+  quiet         bool
+  workDir       string
+  cpus        []int
+  file          JobFile
+  software      Software
+  when          map[*JobParam]*Expr
+  constraints []*constraint
+  excluded      int
 }
 
 // RuntimeConfig contains details about the runtime of wayfinder
@@ -80,10 +131,14 @@ type RuntimeConfig struct {
   BridgeName      string
   BridgeIface     string
   BridgeSubnet    string
+  BridgeMTU       int
+  IsolatedSubnet  string
   ScheduleGrace   int
   WorkDir         string
   AllowOverride   bool
   MaxRetries      int
+  Quiet           bool
+  Software        Software
 }
 
 // tasksInFlight represents the maximum tasks which are actively running
@@ -91,16 +146,16 @@ type RuntimeConfig struct {
 // new task can join.
 var tasksInFlight *CoreMap
 
-// NewJob prepares a job yaml file
-func NewJob(filePath string, cfg *RuntimeConfig, dryRun bool) (*Job, error) {
+// ParseJob reads a job yaml file without preparing any of its tasks
+func ParseJob(filePath string) (*Job, []byte, error) {
   // Check if the path is set
   if len(filePath) == 0 {
-    return nil, fmt.Errorf("File path cannot be empty")
+    return nil, nil, fmt.Errorf("File path cannot be empty")
   }
 
   // Check if the file exists
   if _, err := os.Stat(filePath); os.IsNotExist(err) {
-    return nil, fmt.Errorf("File does not exist: %s", filePath)
+    return nil, nil, fmt.Errorf("File does not exist: %s", filePath)
   }
 
   log.Debugf("Reading job configuration: %s", filePath)
@@ -108,16 +163,63 @@ func NewJob(filePath string, cfg *RuntimeConfig, dryRun bool) (*Job, error) {
   // Slurp the file contents into memory
   dat, err := ioutil.ReadFile(filePath)
   if err != nil {
-    return nil, err
+    return nil, nil, err
   }
 
   if len(dat) == 0 {
-    return nil, fmt.Errorf("File is empty")
+    return nil, nil, fmt.Errorf("File is empty")
+  }
+
+  // Merge the included files and complete the runs with their templates and
+  // the defaults of the job
+  doc, err := loadJobDoc(filePath, dat)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  err = doc.resolveRuns()
+  if err != nil {
+    return nil, nil, err
+  }
+
+  // Check the result against the schema to report all mistakes at once
+  err = doc.validate()
+  if err != nil {
+    return nil, nil, err
+  }
+
+  merged, err := doc.bytes()
+  if err != nil {
+    return nil, nil, err
   }
 
   job := Job{}
 
-  err = yaml.Unmarshal([]byte(dat), &job)
+  // Reject unknown keys, which would otherwise be silently ignored
+  err = yaml.UnmarshalStrict(merged, &job)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  // Generate the parameters of Kconfig sources
+  job.Params, err = importKconfig(job.Params, path.Dir(filePath))
+  if err != nil {
+    return nil, nil, err
+  }
+
+  // Identify the job by the files as written rather than the merged result
+  job.file = JobFile{
+    Path:     filePath,
+    SHA256:   fmt.Sprintf("%x", sha256.Sum256(dat)),
+    Includes: doc.includes,
+  }
+
+  return &job, dat, nil
+}
+
+// NewJob prepares a job yaml file
+func NewJob(filePath string, cfg *RuntimeConfig, dryRun bool) (*Job, error) {
+  job, _, err := ParseJob(filePath)
   if err != nil {
     return nil, err
   }
@@ -128,6 +230,19 @@ func NewJob(filePath string, cfg *RuntimeConfig, dryRun bool) (*Job, error) {
     return nil, fmt.Errorf("You have not set any parameters")
   }
 
+  // Check parameters bound to host knobs exist on this host
+  if !dryRun {
+    for _, param := range job.AllParams() {
+      if len(param.Host) == 0 {
+        continue
+      }
+
+      if _, err := os.Stat(sysctlPath(param.Host)); err != nil {
+        return nil, fmt.Errorf("Invalid host knob for %s: %s", param.Name, err)
+      }
+    }
+  }
+
   // Create all tasks for job, iterating over all possible parameter 
   // permutations
   tasks, err := job.tasks()
@@ -135,11 +250,15 @@ func NewJob(filePath string, cfg *RuntimeConfig, dryRun bool) (*Job, error) {
     return nil, err
   }
 
+  for _, exclusion := range job.Exclusions() {
+    log.Infof("Constraint %s excluded %d permutations", exclusion.Constraint, exclusion.Excluded)
+  }
+
   // Write a tasks file containing all the permutations
   tasksJson := make(map[string]interface{})
   for _, task := range tasks {
     params := make(map[string]string)
-    for _, param := range task.Params {
+    for _, param := range task.params() {
       params[param.Name] = param.Value
     }
     tasksJson[task.UUID()] = params
@@ -165,26 +284,31 @@ func NewJob(filePath string, cfg *RuntimeConfig, dryRun bool) (*Job, error) {
 
   job.dryRun = dryRun
   job.maxRetries = cfg.MaxRetries
+  job.quiet = cfg.Quiet
+  job.workDir = cfg.WorkDir
+  job.cpus = cfg.Cpus
+  job.software = cfg.Software
 
-  // Iterate over all the tasks, check if the run is stasifyable, initialize the
-  // task and add it to the waiting list.
-  for _, task := range tasks {
-    for i, run := range job.Runs {
-      // Check if this particular run has requested more cores than what is
-      if run.Cores > len(cfg.Cpus) {
-        return nil, fmt.Errorf(
-          "Run has too many cores: %s: %d > %d",
-          run.Name,
-          run.Cores,
-          len(cfg.Cpus),
-        )
+  err = job.checkRuns(tasks)
+  if err != nil {
+    return nil, err
+  }
 
-      // Set the default number of cores to use
-      } else if run.Cores == 0 {
-        job.Runs[i].Cores = 1
-      }
+  // Check if any run has requested more cores than what is available
+  for _, run := range job.Runs {
+    if run.Cores > len(cfg.Cpus) {
+      return nil, fmt.Errorf(
+        "Run has too many cores: %s: %d > %d",
+        run.Name,
+        run.Cores,
+        len(cfg.Cpus),
+      )
     }
+  }
 
+  // Iterate over all the tasks, initialize the task and add it to the waiting
+  // list.
+  for _, task := range tasks {
     err := task.Init(cfg.WorkDir, cfg.AllowOverride, &job.Runs, dryRun)
     if err != nil {
       log.Errorf("Could not initialize task: %s", err)
@@ -198,19 +322,162 @@ func NewJob(filePath string, cfg *RuntimeConfig, dryRun bool) (*Job, error) {
   // Prepare a map of cores to hold onto a particular task's run
   tasksInFlight = NewCoreMap(cfg.Cpus)
 
-  // Set up the bridge
+  // Set up the bridge, which is created when the job starts
   job.bridge = &run.Bridge{
     Name:      cfg.BridgeName,
     Interface: cfg.BridgeIface,
     Subnet:    cfg.BridgeSubnet,
+    MTU:       cfg.BridgeMTU,
     CacheDir:  path.Join(cfg.WorkDir, ".cache"),
   }
-  err = job.bridge.Init(dryRun)
+
+  job.knobs = newHostKnobs()
+
+  // Prepare the pool of private bridges for runs with isolated networks
+  job.isolated, err = newIsolatedBridges(cfg.IsolatedSubnet)
   if err != nil {
-    return nil, fmt.Errorf("Could not create bridge: %s", err)
+    return nil, err
+  }
+
+  return job, nil
+}
+
+// checkRuns sets the defaults of each run and checks that the run can be
+// configured with the parameters of every task
+func (j *Job) checkRuns(tasks []*Task) error {
+  for i, r := range j.Runs {
+    // Each run executes exactly one of its path, cmd or entrypoint
+    set := 0
+    for _, ok := range []bool{len(r.Path) > 0, len(r.Cmd) > 0, len(r.Entrypoint) > 0} {
+      if ok {
+        set++
+      }
+    }
+    if set == 0 {
+      return fmt.Errorf("Run %s did not specify path, cmd or entrypoint", r.Name)
+    } else if set > 1 {
+      return fmt.Errorf("Run %s can only specify one of path, cmd or entrypoint", r.Name)
+    } else if len(r.Shell) > 0 && len(r.Cmd) == 0 {
+      return fmt.Errorf("Shell of run %s is only used by cmd", r.Name)
+    }
+
+    // Check the network mode of each run, which is bridged by default
+    switch r.Network {
+    case "":
+      j.Runs[i].Network = run.NetworkBridged
+    case run.NetworkNone, run.NetworkIsolated, run.NetworkBridged, run.NetworkHost:
+    default:
+      return fmt.Errorf("Unknown network mode for run %s: %s", r.Name, r.Network)
+    }
+
+    // Set the default number of cores to use
+    if r.Cores == 0 {
+      j.Runs[i].Cores = 1
+    }
+
+    if r.ParamFile != nil {
+      err := r.ParamFile.Validate()
+      if err != nil {
+        return fmt.Errorf("Invalid param_file for run %s: %s", r.Name, err)
+      }
+    }
+  }
+
+  // Concurrent runs start alongside the runs before them, with which they
+  // form a group sharing the private network of their task
+  group := make([]int, len(j.Runs))
+  for i, r := range j.Runs {
+    group[i] = i
+    if !r.Concurrent {
+      continue
+    } else if i == 0 {
+      return fmt.Errorf("Run %s is concurrent but there is no run before it", r.Name)
+    } else if r.Network != run.NetworkIsolated || j.Runs[i-1].Network != run.NetworkIsolated {
+      return fmt.Errorf(
+        "Concurrent run %s and the run before it must use the isolated network", r.Name,
+      )
+    }
+    group[i] = group[i-1]
+  }
+
+  // Check that outputs are produced and consumed by runs of the job, in order
+  order := make(map[string]int)
+  for i, r := range j.Runs {
+    order[r.Name] = i
+  }
+
+  for _, output := range j.Outputs {
+    produced := -1
+    if len(output.Producer) > 0 {
+      i, ok := order[output.Producer]
+      if !ok {
+        return fmt.Errorf("Output %s is produced by unknown run: %s", output.Path, output.Producer)
+      }
+      produced = i
+    }
+
+    for _, consumer := range output.Consumers {
+      i, ok := order[consumer]
+      if !ok {
+        return fmt.Errorf("Output %s is consumed by unknown run: %s", output.Path, consumer)
+      } else if i <= produced {
+        return fmt.Errorf(
+          "Output %s is consumed by run %s before it is produced by run %s",
+          output.Path, consumer, output.Producer,
+        )
+      } else if produced >= 0 && group[i] == group[produced] {
+        return fmt.Errorf(
+          "Output %s is consumed by run %s while it is produced by run %s alongside it",
+          output.Path, consumer, output.Producer,
+        )
+      }
+    }
+  }
+
+  for _, task := range tasks {
+    // Check that templated inputs render with this task's parameters
+    for _, input := range j.Inputs {
+      if input.Template {
+        err := input.Render("", task.runParams())
+        if err != nil {
+          return fmt.Errorf("Invalid input %s: %s", input.Source, err)
+        }
+      }
+    }
+
+    for _, run := range j.Runs {
+      // Check the network impairment with this task's parameters
+      if run.Netem != nil {
+        err := run.Netem.Expand(task.lookup).Validate()
+        if err != nil {
+          return fmt.Errorf("Invalid netem for run %s: %s", run.Name, err)
+        }
+      }
+
+      // Check the cgroup limits with this task's parameters
+      if run.Resources != nil {
+        err := run.Resources.Expand(task.lookup).Validate()
+        if err != nil {
+          return fmt.Errorf("Invalid resources for run %s: %s", run.Name, err)
+        }
+      }
+
+      // Processes are started in an absolute working directory
+      if workdir := task.Expand(run.Workdir); len(workdir) > 0 && !path.IsAbs(workdir) {
+        return fmt.Errorf("Working directory of run %s is not absolute: %s", run.Name, workdir)
+      }
+
+      // Check that the template renders with this task's parameters
+      if run.ParamFile != nil && run.ParamFile.Format == "template" {
+        _, err := run.ParamFile.Render(task.runParams())
+        if err != nil {
+          return fmt.Errorf("Invalid param_file for run %s: %s", run.Name, err)
+        }
+      }
+    }
   }
 
-  return &job, nil
+  return nil
 }
 
 // parseParamInt attends to string parameters and its possible permutations
@@ -268,43 +535,25 @@ func parseParamInt(param *JobParam) ([]TaskParam, error) {
       )
     }
 
-    // Figure out the step
-    step := 1
-    if len(param.Step) > 0 {
-      step, err = strconv.Atoi(param.Step)
-      if err != nil || step == 0 {
-        return nil, fmt.Errorf(
-          "Invalid step for %s: %s", param.Name, param.Step,
-        )
-      }
+    values, err := stepValues(param, float64(min), float64(max))
+    if err != nil {
+      return nil, err
     }
 
-    // Use iterative step
-    if len(param.StepMode) == 0 || param.StepMode == "increment" {
-      for i := min; i <= max; i += step {
-        params = append(params, TaskParam{
-          Name:  param.Name,
-          Type:  param.Type,
-          Value: strconv.Itoa(i),
-        })
-      }
-
-    // Use exponential step
-    } else if param.StepMode == "power" {
-      for i, j := min, min; i <= max; j++ {
-        params = append(params, TaskParam{
-          Name:  param.Name,
-          Type:  param.Type,
-          Value: strconv.Itoa(i),
-        })
-        i = int(math.Pow(float64(step), float64(j)))
+    // Values of geometric steps are rounded and may collapse for small ranges
+    last := ""
+    for _, v := range values {
+      value := strconv.FormatInt(int64(math.Round(v)), 10)
+      if value == last {
+        continue
       }
+      last = value
 
-    // Unknown step mode
-    } else {
-      return nil, fmt.Errorf(
-        "Unknown step mode for param %s: %s", param.Name, param.StepMode,
-      )
+      params = append(params, TaskParam{
+        Name:  param.Name,
+        Type:  param.Type,
+        Value: value,
+      })
     }
 
   } else if len(param.Default) > 0 {
@@ -321,134 +570,618 @@ func parseParamInt(param *JobParam) ([]TaskParam, error) {
   return params, nil
 }
 
+// stepValues generates the values of a parameter between min and max
+// according to its step mode:
+//
+//   increment: min, min+step, min+2*step, ... (default)
+//   multiply:  min, min*step, min*step^2, ... (power is an alias)
+//   linspace:  count evenly spaced values from min to max
+//   log:       count logarithmically spaced values from min to max, or without
+//              a count, values which are step decades apart
+func stepValues(param *JobParam, min, max float64) ([]float64, error) {
+  var err error
+  var values []float64
+
+  step := 0.0
+  if len(param.Step) > 0 {
+    step, err = strconv.ParseFloat(param.Step, 64)
+    if err != nil || step <= 0 {
+      return nil, fmt.Errorf("Invalid step for %s: %s", param.Name, param.Step)
+    }
+  }
+
+  count := 0
+  if len(param.Count) > 0 {
+    count, err = strconv.Atoi(param.Count)
+    if err != nil || count < 1 {
+      return nil, fmt.Errorf("Invalid count for %s: %s", param.Name, param.Count)
+    } else if param.StepMode != "linspace" && param.StepMode != "log" {
+      return nil, fmt.Errorf("Count of %s requires step mode linspace or log", param.Name)
+    }
+  }
+
+  // Allow for the rounding of the last step
+  limit := max + math.Abs(max) * 1e-9
+
+  switch param.StepMode {
+  case "", "increment":
+    if step == 0 {
+      step = 1
+    }
+    for i := 0; min + float64(i) * step <= limit; i++ {
+      values = append(values, min + float64(i) * step)
+    }
+
+  case "multiply", "power":
+    // Power used to raise step to successive exponents starting from min
+    if param.StepMode == "power" {
+      log.Warnf(
+        "Step mode power of %s is deprecated and now multiplies min by step, use multiply",
+        param.Name,
+      )
+    }
+    if step == 0 {
+      step = 2
+    } else if step <= 1 {
+      return nil, fmt.Errorf("Step must be greater than 1 to multiply %s", param.Name)
+    }
+    if min <= 0 {
+      return nil, fmt.Errorf("Min must be positive to multiply %s", param.Name)
+    }
+    for v := min; v <= limit; v *= step {
+      values = append(values, v)
+    }
+
+  case "linspace":
+    if count == 0 {
+      return nil, fmt.Errorf("Step mode linspace of %s requires a count", param.Name)
+    }
+    for i := 0; i < count; i++ {
+      if count == 1 {
+        values = append(values, min)
+        break
+      }
+      values = append(values, min + float64(i) * (max - min) / float64(count - 1))
+    }
+
+  case "log":
+    if min <= 0 {
+      return nil, fmt.Errorf("Min must be positive for log steps of %s", param.Name)
+    }
+    if count > 0 {
+      for i := 0; i < count; i++ {
+        if count == 1 {
+          values = append(values, min)
+          break
+        }
+        values = append(values, min * math.Pow(max / min, float64(i) / float64(count - 1)))
+      }
+    } else {
+      if step == 0 {
+        step = 1
+      }
+      for i := 0; min * math.Pow(10, float64(i) * step) <= limit; i++ {
+        values = append(values, min * math.Pow(10, float64(i) * step))
+      }
+    }
+
+  default:
+    return nil, fmt.Errorf(
+      "Unknown step mode for param %s: %s", param.Name, param.StepMode,
+    )
+  }
+
+  return values, nil
+}
+
+// formatFloat returns the shortest representation of a float rounded to 12
+// significant digits, so that stepping does not accumulate rounding errors
+func formatFloat(f float64) string {
+  f, _ = strconv.ParseFloat(strconv.FormatFloat(f, 'g', 12, 64), 64)
+  return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// parseParamFloat attends to float parameters and its possible permutations
+func parseParamFloat(param *JobParam) ([]TaskParam, error) {
+  var params []TaskParam
+
+  // Fixed values are used as they are
+  if len(param.Only) > 0 || len(param.Min) == 0 {
+    for _, val := range append([]string{param.Default}, param.Only...) {
+      if _, err := strconv.ParseFloat(val, 64); len(val) > 0 && err != nil {
+        return nil, fmt.Errorf("Invalid float for %s: %s", param.Name, val)
+      }
+    }
+    return parseParamStr(param)
+  }
+
+  min, err := strconv.ParseFloat(param.Min, 64)
+  if err != nil {
+    return nil, fmt.Errorf("Invalid min for %s: %s", param.Name, param.Min)
+  }
+
+  max, err := strconv.ParseFloat(param.Max, 64)
+  if err != nil {
+    return nil, fmt.Errorf("Invalid max for %s: %s", param.Name, param.Max)
+  }
+
+  if max < min {
+    return nil, fmt.Errorf(
+      "Min can't be greater than max for %s: %s < %s", param.Name, param.Min, param.Max,
+    )
+  }
+
+  values, err := stepValues(param, min, max)
+  if err != nil {
+    return nil, err
+  }
+
+  for _, v := range values {
+    params = append(params, TaskParam{
+      Name:  param.Name,
+      Type:  param.Type,
+      Value: formatFloat(v),
+    })
+  }
+
+  return params, nil
+}
+
+// parseParamBool attends to boolean parameters, which are swept across both
+// values unless restricted with only.  The values are rendered as true_value
+// and false_value, e.g. `y` and `n` for Kconfig options.
+func parseParamBool(param *JobParam) ([]TaskParam, error) {
+  var params []TaskParam
+
+  render := map[bool]string{true: "true", false: "false"}
+  if len(param.TrueValue) > 0 {
+    render[true] = param.TrueValue
+  }
+  if len(param.FalseValue) > 0 {
+    render[false] = param.FalseValue
+  }
+
+  values := []bool{true, false}
+  if len(param.Only) > 0 {
+    values = nil
+    for _, val := range param.Only {
+      switch val {
+      case render[true]:
+        values = append(values, true)
+      case render[false]:
+        values = append(values, false)
+      default:
+        b, err := strconv.ParseBool(val)
+        if err != nil {
+          return nil, fmt.Errorf("Invalid bool for %s: %s", param.Name, val)
+        }
+        values = append(values, b)
+      }
+    }
+  }
+
+  for _, val := range values {
+    params = append(params, TaskParam{
+      Name:  param.Name,
+      Type:  param.Type,
+      Value: render[val],
+    })
+  }
+
+  return params, nil
+}
+
+// parseParamSize attends to size parameters, e.g. `4K` or `1MiB`, which are
+// swept like integers and rendered in bytes
+func parseParamSize(param *JobParam) ([]TaskParam, error) {
+  bytes := func(field, val string) (string, error) {
+    if len(val) == 0 {
+      return "", nil
+    }
+
+    size, err := run.ParseSize(val)
+    if err != nil {
+      return "", fmt.Errorf("Invalid %s for %s: %s", field, param.Name, err)
+    }
+
+    return strconv.FormatInt(size, 10), nil
+  }
+
+  p := *param
+  var err error
+  if p.Min, err = bytes("min", param.Min); err != nil {
+    return nil, err
+  }
+  if p.Max, err = bytes("max", param.Max); err != nil {
+    return nil, err
+  }
+  if p.Default, err = bytes("default", param.Default); err != nil {
+    return nil, err
+  }
+
+  // Multiplying steps use the step as a factor rather than a size
+  if p.StepMode != "multiply" && p.StepMode != "power" {
+    if p.Step, err = bytes("step", param.Step); err != nil {
+      return nil, err
+    }
+  }
+
+  p.Only = nil
+  for _, val := range param.Only {
+    b, err := bytes("value", val)
+    if err != nil {
+      return nil, err
+    }
+    p.Only = append(p.Only, b)
+  }
+
+  return parseParamInt(&p)
+}
+
 // paramPermutations discovers all the possible variants of a particular
 // parameter based on its type and options.
 func paramPermutations(param *JobParam) ([]TaskParam, error) {
   switch t := param.Type; t {
-  case "string":
+  case "string", "choice":
     return parseParamStr(param)
   case "int":
     return parseParamInt(param)
   case "integer":
     return parseParamInt(param)
+  case "float":
+    return parseParamFloat(param)
+  case "bool", "boolean":
+    return parseParamBool(param)
+  case "size":
+    return parseParamSize(param)
   }
   return nil, fmt.Errorf(
     "Unknown parameter type: \"%s\" for %s", param.Type, param.Name,
   )
 }
 
-func (j *Job) isInArray(param JobParam) (bool) {
-  for _, par := range j.Params {
-    if par.Name == param.Name {
-      return true
+// bareWord matches legacy `when` conditions, which are compared with the value
+// of the parent parameter, e.g. `when: y`
+var bareWord = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+// treeParam is a parameter waiting to be expanded along with its parent and the
+// names of its ancestors
+type treeParam struct {
+  param     *JobParam
+  parent    *JobParam
+  ancestors []string
+}
+
+// children returns the nodes of the parameter's sub-parameters
+func (n *treeParam) children() []treeParam {
+  var nodes []treeParam
+  ancestors := append([]string{}, n.ancestors...)
+  for _, m := range n.param.members() {
+    ancestors = append(ancestors, m.Name)
+  }
+  for i := range n.param.Params {
+    nodes = append(nodes, treeParam{
+      param:     &n.param.Params[i],
+      parent:    n.param,
+      ancestors: ancestors,
+    })
+  }
+  return nodes
+}
+
+// compileWhen parses the condition of a parameter.  A bare word which is not
+// the name of an ancestor is compared for equality with the parent's value.
+func compileWhen(n *treeParam) (*Expr, error) {
+  when := strings.TrimSpace(n.param.When)
+
+  legacy := bareWord.MatchString(when)
+  for _, name := range n.ancestors {
+    legacy = legacy && name != when
+  }
+
+  if !legacy {
+    expr, err := ParseExpr(when)
+    if err != nil {
+      return nil, fmt.Errorf("Invalid condition for %s: %s", n.param.label(), err)
+    }
+    return expr, nil
+  }
+
+  if n.parent == nil {
+    return nil, fmt.Errorf(
+      "Condition of %s compares with the parent, but it has none: %s",
+      n.param.label(), when,
+    )
+  } else if len(n.parent.Zip) > 0 {
+    return nil, fmt.Errorf(
+      "Condition of %s compares with a zip group, use an expression instead: %s",
+      n.param.label(), when,
+    )
+  }
+
+  return &Expr{
+    src:  fmt.Sprintf("%s == %q", n.parent.Name, when),
+    root: &binaryNode{
+      op:    "==",
+      left:  &paramNode{n.parent.Name},
+      right: &literalNode{when},
+    },
+    params: []string{n.parent.Name},
+  }, nil
+}
+
+// checkParams checks the names and conditions of the parameter tree before it
+// is expanded.  Names are unique across the job and are recorded in the order
+// parameters are expanded, so that conditions may only reference parameters
+// which precede them.
+func (j *Job) checkParams(nodes []treeParam, names map[string]bool) error {
+  for _, n := range nodes {
+    // Members of zip groups are plain parameters which are iterated together
+    if len(n.param.Zip) > 0 {
+      if len(n.param.Name) > 0 || len(n.param.Type) > 0 || len(n.param.Host) > 0 {
+        return fmt.Errorf("Zip group %s cannot have a name, type or host", n.param.label())
+      }
+
+      for _, m := range n.param.members() {
+        if len(m.Params) > 0 || len(m.When) > 0 || len(m.Zip) > 0 {
+          return fmt.Errorf(
+            "Member %s of zip group cannot have params, when or zip", m.Name,
+          )
+        }
+      }
+    }
+
+    // Conditions are evaluated with the values of the parameters before them
+    if len(n.param.When) > 0 {
+      expr, err := compileWhen(&n)
+      if err != nil {
+        return err
+      }
+
+      for _, name := range expr.Params() {
+        if !names[name] {
+          return fmt.Errorf(
+            "Condition of %s references %s, which is not a parameter before it",
+            n.param.label(), name,
+          )
+        }
+      }
+
+      j.when[n.param] = expr
+    }
+
+    for _, m := range n.param.members() {
+      if len(m.Name) == 0 {
+        return fmt.Errorf("Parameter is missing a name")
+      } else if names[m.Name] {
+        return fmt.Errorf("Duplicate parameter: %s", m.Name)
+      }
+      names[m.Name] = true
+    }
+
+    err := j.checkParams(n.children(), names)
+    if err != nil {
+      return err
     }
   }
-  return false
+
+  return nil
 }
 
-// nextTask recursively iterates across paramters to generate a set of tasks
-func (j *Job) nextTask(i int, tasks []*Task, curr []TaskParam) ([]*Task, error) {
+// expand recursively iterates across the parameter tree in order to generate a
+// set of tasks.  The values of each parameter are followed by its active
+// sub-parameters and then its remaining siblings.  A sub-parameter is active
+// when its condition holds for the values of the parameters before it,
+// otherwise it is omitted from the task.
+func (j *Job) expand(pending []treeParam, curr []TaskParam, tasks []*Task) ([]*Task, error) {
+  if len(pending) == 0 {
+    // Skip permutations which do not satisfy the constraints, which may use
+    // derived parameters.  A derived parameter which cannot be computed only
+    // fails the job if its permutation is not excluded.
+    derived, deriveErr := j.derive(curr)
+    ok, err := j.satisfies(append(append([]TaskParam{}, curr...), derived...))
+    if err != nil {
+      return nil, err
+    } else if !ok {
+      return tasks, nil
+    } else if deriveErr != nil {
+      return nil, deriveErr
+    }
+
+    return append(tasks, &Task{
+      Inputs:  &j.Inputs,
+      Outputs: &j.Outputs,
+      Params:   curr,
+      Derived:  derived,
+    }), nil
+  }
+
+  n := pending[0]
+  rest := pending[1:]
+
+  // Check if the condition of the parameter is met, where a condition which
+  // references an inactive parameter does not hold.  Conditions only reference
+  // parameters declared before them, which checkParams ensures.
+  if expr, ok := j.when[n.param]; ok {
+    active, err := expr.EvalBool(func(name string) (string, bool) {
+      return paramValue(curr, name)
+    })
+    if _, unknown := err.(errUnknownParam); unknown {
+      active = false
+    } else if err != nil {
+      return nil, fmt.Errorf("Could not evaluate condition of %s: %s", n.param.label(), err)
+    }
+
+    if !active {
+      return j.expand(rest, curr, tasks)
+    }
+  }
+
   // List all permutations for this parameter
-  params, err := paramPermutations(&j.Params[i])
+  rows, err := paramRows(n.param)
   if err != nil {
     return nil, err
   }
 
-  // If the current parameter has subparameters, add them to the jobs parameter list
-  // TODO: Check if they are already in the list!
-  if len(j.Params[i].Params) > 0 {
-    for _, subParam := range j.Params[i].Params {
-      if !j.isInArray(subParam) {
-        j.Params = append(j.Params, JobParam{}) // Make space for new element
-        copy(j.Params[(i+2):], j.Params[(i+1):]) // Shift elements
-        j.Params[i+1] = subParam // Insert the new sub parameter
-      }
+  // Sub-parameters are expanded directly after their parent
+  next := append(n.children(), rest...)
+
+  for _, row := range rows {
+    p := make([]TaskParam, len(curr), len(curr)+len(row))
+    copy(p, curr)
+
+    tasks, err = j.expand(next, append(p, row...), tasks)
+    if err != nil {
+      return nil, err
     }
   }
 
-  for _, param := range params {
-    if len(curr) > 0 {
-      last := curr[len(curr)-1]
-      if last.Name == param.Name {
-        curr = curr[:len(curr)-1]
-      }
+  return tasks, nil
+}
+
+// paramRows returns the values of a parameter as one dimension of the
+// permutations.  The members of a zip group are iterated in lockstep, so that
+// each row holds the i-th value of every member.
+func paramRows(param *JobParam) ([][]TaskParam, error) {
+  var rows [][]TaskParam
+
+  members := param.members()
+  for i, m := range members {
+    params, err := paramPermutations(m)
+    if err != nil {
+      return nil, err
     }
 
-    // Check if when-condition of a subparameter is met
-    if len(j.Params[i].When) > 0 {
+    if i == 0 {
+      rows = make([][]TaskParam, len(params))
+    } else if len(params) != len(rows) {
+      return nil, fmt.Errorf(
+        "Members of %s must have the same number of values: %s has %d, %s has %d",
+        param.label(), members[0].Name, len(rows), m.Name, len(params),
+      )
+    }
 
-      print("Current param is " + j.Params[i].Name + "; Comp is " + j.Params[i].Comp + "; When is " + j.Params[i].When + "\n")
-      if j.Params[i].When == j.Params[i].Comp {
-	    curr = append(curr, param)
-      }
-    } else {
-      curr = append(curr, param)
-    }
-
-    // Remember value for each of the parameters subparameters
-    if len(j.Params[i].Params) > 0 {
-	    print(j.Params[i].Name + " has subparameters:\n")
-	    for _, subParam := range j.Params[i].Params {
-	      print(subParam.Name + "\n")
-	    }
-      for _, subParam := range j.Params[i].Params {
-	for c := 0; c < len(j.Params); c++ {
-	  if subParam.Name == j.Params[c].Name {
-            j.Params[c].Comp = param.Value
-          }
-	}
+    for k, p := range params {
+      // Bind the values to the host knob of the parameter
+      if len(m.Host) > 0 {
+        p.Host = sysctlPath(m.Host)
       }
-      /*for k, _ := range j.Params[i].Params {
-	      j.Params[1+i+k].Comp = param.Value
-	      print("Subparameter " + j.Params[1+i+k].Name + " has Comp " + j.Params[1+i+k].Comp + "\n")
-      }*/
+      rows[k] = append(rows[k], p)
     }
+  }
 
-    // Break when there are no more parameters to iterate over, thus creating
-    // the task.
-    if i + 1 == len(j.Params) {
-      var p = make([]TaskParam, len(curr)) // len(j.Params) used to be here instead of len(curr)
-      copy(p, curr)
-      task := &Task{
-        Inputs:  &j.Inputs,
-        Outputs: &j.Outputs,
-        Params:   p,
-      }
-      tasks = append(tasks, task)
-      print("Task building completed\n___________________________________________")
+  return rows, nil
+}
 
-    // Otherwise, recursively parse parameters in-order    
-    } else {
-      nextTasks, err := j.nextTask(i + 1, nil, curr)
-      if err != nil {
-        return nil, err
-      }
+// rootParams returns the nodes of the top-level parameters
+func (j *Job) rootParams() []treeParam {
+  var nodes []treeParam
+  for i := range j.Params {
+    nodes = append(nodes, treeParam{param: &j.Params[i]})
+  }
+  return nodes
+}
+
+// AllParams returns every parameter of the job, including sub-parameters, in
+// the order they are expanded
+func (j *Job) AllParams() []*JobParam {
+  var params []*JobParam
 
-      tasks = append(tasks, nextTasks...)
+  var walk func(nodes []treeParam)
+  walk = func(nodes []treeParam) {
+    for _, n := range nodes {
+      params = append(params, n.param.members()...)
+      walk(n.children())
     }
   }
+  walk(j.rootParams())
 
-  return tasks, nil
+  return params
 }
 
 // tasks returns a list of all possible tasks based on parameterisation
 func (j *Job) tasks() ([]*Task, error) {
-  var tasks []*Task
+  j.when = make(map[*JobParam]*Expr)
+  err := j.checkParams(j.rootParams(), make(map[string]bool))
+  if err != nil {
+    return nil, err
+  }
 
-  tasks, err := j.nextTask(0, tasks, nil)
+  err = j.parseDerived()
   if err != nil {
     return nil, err
   }
 
-  return tasks, nil
+  err = j.parseConstraints()
+  if err != nil {
+    return nil, err
+  }
+
+  return j.expand(j.rootParams(), nil, nil)
+}
+
+// PrepareEnvironment applies the job's host profile merged over the default
+// profile and records the applied settings with the results
+func (j *Job) PrepareEnvironment(cpus []int) error {
+  profile := j.Host.Merge()
+
+  // Persist original values so they can be restored after a crash
+  if !j.dryRun {
+    err := OpenJournal(HostJournal(j.workDir))
+    if err != nil {
+      return fmt.Errorf("Could not open host journal: %s", err)
+    }
+  }
+
+  err := PrepareEnvironment(profile, cpus, j.dryRun)
+  if err != nil {
+    return err
+  }
+
+  hostFile := path.Join(j.workDir, "results", "host.json")
+  log.Debugf("Writing host settings file %s...", hostFile)
+  err = writeHostSettings(hostFile, profile.Settings(cpus))
+  if err != nil {
+    return fmt.Errorf("Could not write host settings file: %s", err)
+  }
+
+  return nil
+}
+
+// groupCores returns the number of cores required by the run and by the
+// concurrent runs which start alongside it
+func (j *Job) groupCores(name string) int {
+  cores := 0
+  for i, r := range j.Runs {
+    if r.Name != name {
+      continue
+    }
+
+    cores = r.Cores
+    for _, next := range j.Runs[i+1:] {
+      if !next.Concurrent {
+        break
+      }
+      cores += next.Cores
+    }
+  }
+  return cores
 }
 
 // Start the job and all of its tasks
 func (j *Job) Start() error {
   var freeCores []int
   var wg sync.WaitGroup
+  var scheduled bool
+
+  // Create the bridge once for all runs of this job
+  err := j.bridge.Init(j.dryRun)
+  if err != nil {
+    return fmt.Errorf("Could not create bridge: %s", err)
+  }
 
   // Pre-emptively pull all images
+  images := make(map[string]string)
   for _, r := range j.Runs {
     ref, err := dockerparser.Parse(r.Image)
     if err != nil {
@@ -457,10 +1190,23 @@ func (j *Job) Start() error {
 
     log.Infof("Pulling %s...", ref.Remote())
 
-    _, err = run.PullImage(ref.Remote(), j.bridge.CacheDir)
+    image, err := run.PullImage(ref.Remote(), j.bridge.CacheDir)
     if err != nil {
       return fmt.Errorf("Could not pull image: %s", err)
     }
+
+    digest, err := image.Digest()
+    if err != nil {
+      return fmt.Errorf("Could not process digest: %s", err)
+    }
+
+    images[ref.Remote()] = digest.String()
+  }
+
+  // Record what is producing the results of this job
+  err = j.writeProvenance(images)
+  if err != nil {
+    return fmt.Errorf("Could not write provenance: %s", err)
   }
 
   curTaskNum := 0
@@ -476,6 +1222,7 @@ func (j *Job) Start() error {
     if len(freeCores) == 0 {
       continue
     }
+    scheduled = false
 
     // Get the next task from the job's queue
     task, err := j.waitList.Get(i)
@@ -493,19 +1240,35 @@ func (j *Job) Start() error {
       log.Errorf("Could not peak next run for task: %d: %s", i, err)
 
     // Can we schedule this run?  Use an else if here so we don't ruin the
-    // ordering of the iterator `i`
-    } else if len(freeCores) >= nextRun.(run.Run).Cores {
-      // Check if the peaked run is currently active
-      tasksInFlight.RLock()
-      for _, atr := range tasksInFlight.All() {
-        if atr != nil {
-          if atr.Task.UUID() == task.(*Task).UUID() {
-            tasksInFlight.RUnlock()
-            goto iterator
+    // ordering of the iterator `i`.  The first run of a group of concurrent
+    // runs waits until there are enough cores for the whole group.
+    } else if (nextRun.(run.Run).Concurrent && len(freeCores) >= nextRun.(run.Run).Cores) ||
+              len(freeCores) >= j.groupCores(nextRun.(run.Run).Name) {
+      // Check if the task has a run which is currently active, which only
+      // concurrent runs can start alongside
+      if !nextRun.(run.Run).Concurrent {
+        tasksInFlight.RLock()
+        for _, atr := range tasksInFlight.All() {
+          if atr != nil {
+            if atr.Task.UUID() == task.(*Task).UUID() {
+              tasksInFlight.RUnlock()
+              goto iterator
+            }
           }
         }
+        tasksInFlight.RUnlock()
+      }
+
+      // Apply the task's host knobs, unless they conflict with those of
+      // another task in flight in which case the task must wait
+      ok, err := j.knobs.Acquire(task.(*Task), j.dryRun)
+      if err != nil {
+        log.Errorf("Could not prepare host for task: %s", err)
+        task.(*Task).Cancel()
+        goto iterator
+      } else if !ok {
+        goto iterator
       }
-      tasksInFlight.RUnlock()
 
       // Select some core IDs for this run based on how many it requires
       var cores []int
@@ -514,14 +1277,35 @@ func (j *Job) Start() error {
         freeCores = freeCores[:len(freeCores)-1]
       }
 
+      // Select the network the run is attached to
+      var bridge *run.Bridge
+      switch nextRun.(run.Run).Network {
+      case run.NetworkBridged:
+        bridge = j.bridge
+      case run.NetworkIsolated:
+        bridge, err = j.isolated.Get(
+          task.(*Task),
+          j.bridge.CacheDir,
+          j.dryRun,
+        )
+        if err != nil {
+          log.Errorf("Could not create isolated network for task: %s", err)
+          task.(*Task).Cancel()
+          j.knobs.Release(task.(*Task), j.dryRun)
+          freeCores = append(freeCores, cores...)
+          goto iterator
+        }
+      }
+
       // Initialize the task run
       activeTaskRun, err := NewActiveTaskRun(
         task.(*Task),
         nextRun.(run.Run),
         cores,
-        j.bridge,
+        bridge,
         j.dryRun,
         j.maxRetries,
+        j.quiet,
       )
       if err != nil {
         log.Errorf("Could not initialize run for this task: %s", err)
@@ -529,6 +1313,9 @@ func (j *Job) Start() error {
         // By cancelling all the subsequent runs, the task will be removed from 
         // scheduler.
         task.(*Task).Cancel()
+        j.isolated.Release(task.(*Task), j.dryRun)
+        j.knobs.Release(task.(*Task), j.dryRun)
+        freeCores = append(freeCores, cores...)
         goto iterator
       }
 
@@ -541,26 +1328,28 @@ func (j *Job) Start() error {
 
       // Finally, we can dequeue the run since we are about to schedule it
       nextRun, err = task.(*Task).runs.Dequeue()
+      atomic.AddInt32(&task.(*Task).active, 1)
+      scheduled = true
 
       // Add the active task to the list of utilised cores
-      j := 1
+      k := 1
       for len(cores) > 0 {
-        coreId := cores[len(cores)-j]
+        coreId := cores[len(cores)-k]
         err := tasksInFlight.Set(coreId, activeTaskRun)
         if err != nil {
           log.Warnf("Could not schedule task on core ID %d: %s", coreId, err)
 
           // Use an offset to be able to skip over unavailable cores
-          if j >= len(cores) {
-            j = 1
+          if k >= len(cores) {
+            k = 1
           } else {
-            j = j + 1
+            k = k + 1
           }
           continue
         }
 
         // If we are able to use the core, remove it from the list
-        cores = cores[:len(cores)-j]
+        cores = cores[:len(cores)-k]
       }
 
       // Create a thread where we oversee the runtime of this task's run.  By
@@ -603,6 +1392,13 @@ func (j *Job) Start() error {
         }
 
 activeTaskDone:
+        // Tear down the task's private network and restore its host knobs
+        // once it has no more runs, including those running alongside
+        if atomic.AddInt32(&task.(*Task).active, -1) == 0 && task.(*Task).runs.Len() == 0 {
+          j.isolated.Release(task.(*Task), j.dryRun)
+          j.knobs.Release(task.(*Task), j.dryRun)
+        }
+
         wg.Done() // We're done here
 
         // Remove utilized cores from this active task's run
@@ -619,6 +1415,11 @@ iterator:
     if task.(*Task).runs.Len() == 0 {
       j.waitList.Remove(i)
       i = i - 1
+
+    // Start the rest of a group of concurrent runs before the next task
+    } else if next, err := task.(*Task).runs.Peak(); scheduled && err == nil &&
+              next.(run.Run).Concurrent {
+      continue
     }
 
     // Have we reached the end of the list?  Go back to zero otherwise continue.
@@ -634,18 +1435,40 @@ iterator:
   return nil
 }
 
-// Cleanup provides a way to deschedule all currently active tasks
+// Cleanup provides a way to deschedule all currently active tasks and tear
+// down the job's network
 func (j *Job) Cleanup() {
   // Iterate through active tasks
-  for _, atr := range tasksInFlight.All() {
-    // Skip cores which do not have a task
-    if atr == nil {
-      continue
+  if tasksInFlight != nil {
+    for _, atr := range tasksInFlight.All() {
+      // Skip cores which do not have a task
+      if atr == nil || atr.Runner == nil {
+        continue
+      }
+
+      err := atr.Runner.Destroy()
+      if err != nil {
+        log.Warnf("Could not destroy runner: %s", err)
+      }
+    }
+  }
+
+  if j.isolated != nil {
+    j.isolated.ReleaseAll(j.dryRun)
+  }
+
+  if j.bridge != nil {
+    err := j.bridge.Destroy(j.dryRun)
+    if err != nil {
+      log.Warnf("Could not destroy bridge: %s", err)
     }
+  }
 
-    err := atr.Runner.Destroy()
+  // Remove the parent cgroup once all runs have been destroyed
+  if !j.dryRun {
+    err := run.RemoveCgroupParent()
     if err != nil {
-      log.Warnf("Could not destroy runner: %s", err)
+      log.Warnf("Could not remove cgroup %s: %s", run.CgroupParent, err)
     }
   }
 }
@@ -0,0 +1,503 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "reflect"
+  "strings"
+  "testing"
+
+  "github.com/lancs-net/wayfinder/run"
+)
+
+func TestStepValues(t *testing.T) {
+  tests := []struct {
+    param  JobParam
+    min    float64
+    max    float64
+    values []float64
+    err    string
+  }{
+    {JobParam{}, 1, 4, []float64{1, 2, 3, 4}, ""},
+    {JobParam{Step: "0.5"}, 0, 1, []float64{0, 0.5, 1}, ""},
+    {JobParam{StepMode: "multiply"}, 1, 10, []float64{1, 2, 4, 8}, ""},
+    {JobParam{StepMode: "power", Step: "3"}, 1, 10, []float64{1, 3, 9}, ""},
+    {JobParam{StepMode: "linspace", Count: "3"}, 0, 10, []float64{0, 5, 10}, ""},
+    {JobParam{StepMode: "linspace", Count: "1"}, 2, 10, []float64{2}, ""},
+    {JobParam{StepMode: "log"}, 1, 1000, []float64{1, 10, 100, 1000}, ""},
+    {JobParam{StepMode: "log", Count: "3"}, 1, 100, []float64{1, 10, 100}, ""},
+    {JobParam{Step: "0"}, 1, 4, nil, "Invalid step"},
+    {JobParam{StepMode: "multiply", Step: "1"}, 1, 4, nil, "greater than 1"},
+    {JobParam{StepMode: "multiply"}, 0, 4, nil, "Min must be positive"},
+    {JobParam{StepMode: "linspace"}, 0, 4, nil, "requires a count"},
+    {JobParam{StepMode: "linspace", Count: "0"}, 0, 4, nil, "Invalid count"},
+    {JobParam{Count: "4"}, 0, 4, nil, "requires step mode"},
+    {JobParam{StepMode: "multiply", Step: "1", Count: "4"}, 0, 4, nil, "requires step mode"},
+    {JobParam{StepMode: "square"}, 0, 4, nil, "Unknown step mode"},
+  }
+
+  for _, test := range tests {
+    values, err := stepValues(&test.param, test.min, test.max)
+    if len(test.err) > 0 {
+      if err == nil || !strings.Contains(err.Error(), test.err) {
+        t.Errorf("%+v: expected error %q, got %v", test.param, test.err, err)
+      }
+      continue
+    } else if err != nil {
+      t.Errorf("%+v: %s", test.param, err)
+      continue
+    }
+
+    // Compare the values as they are formatted for tasks
+    var got, expected []string
+    for _, v := range values {
+      got = append(got, formatFloat(v))
+    }
+    for _, v := range test.values {
+      expected = append(expected, formatFloat(v))
+    }
+
+    if !reflect.DeepEqual(got, expected) {
+      t.Errorf("%+v: expected %v, got %v", test.param, expected, got)
+    }
+  }
+}
+
+// taskStrings returns each task as its parameters, e.g. `A=1 B=2`
+func taskStrings(tasks []*Task) []string {
+  var out []string
+  for _, task := range tasks {
+    var params []string
+    for _, p := range task.Params {
+      params = append(params, p.Name+"="+p.Value)
+    }
+    out = append(out, strings.Join(params, " "))
+  }
+  return out
+}
+
+func TestWhen(t *testing.T) {
+  pools := func(sub ...JobParam) []JobParam {
+    return []JobParam{{Name: "POOLS", Type: "string", Only: []string{"y", "n"}, Params: sub}}
+  }
+
+  tests := []struct {
+    name   string
+    params []JobParam
+    tasks  []string
+    err    string
+  }{{
+    name: "bare word compares with the parent",
+    params: pools(JobParam{Name: "CON", Type: "int", Only: []string{"8", "64"}, When: "y"}),
+    tasks:  []string{"POOLS=y CON=8", "POOLS=y CON=64", "POOLS=n"},
+  }, {
+    name: "bare number compares with the parent",
+    params: []JobParam{{Name: "A", Type: "int", Only: []string{"1", "2"}, Params: []JobParam{
+      {Name: "B", Type: "string", Only: []string{"x"}, When: "2"},
+    }}},
+    tasks: []string{"A=1", "A=2 B=x"},
+  }, {
+    name: "bare word naming an ancestor is an expression",
+    params: []JobParam{{Name: "A", Type: "bool", Params: []JobParam{
+      {Name: "B", Type: "string", Only: []string{"x"}, When: "A"},
+    }}},
+    tasks: []string{"A=true B=x", "A=false"},
+  }, {
+    name: "expression over ancestors",
+    params: pools(JobParam{Name: "CON", Type: "int", Only: []string{"8", "64"}, When: `POOLS == "y"`,
+      Params: []JobParam{{Name: "LIS", Type: "int", Only: []string{"8", "32"}, When: "CON > 8"}},
+    }),
+    tasks: []string{"POOLS=y CON=8", "POOLS=y CON=64 LIS=8", "POOLS=y CON=64 LIS=32", "POOLS=n"},
+  }, {
+    name: "expression over a preceding sibling",
+    params: []JobParam{
+      {Name: "A", Type: "int", Only: []string{"1", "2"}},
+      {Name: "B", Type: "string", Only: []string{"x"}, When: "A > 1"},
+    },
+    tasks: []string{"A=1", "A=2 B=x"},
+  }, {
+    name: "condition over an inactive parameter does not hold",
+    params: pools(
+      JobParam{Name: "CON", Type: "int", Only: []string{"8"}, When: "y"},
+      JobParam{Name: "LIS", Type: "int", Only: []string{"4"}, When: "CON == 8"},
+    ),
+    tasks: []string{"POOLS=y CON=8 LIS=4", "POOLS=n"},
+  }, {
+    name: "condition on a root parameter",
+    params: []JobParam{
+      {Name: "A", Type: "int", Only: []string{"1"}},
+      {Name: "B", Type: "int", Only: []string{"2"}, When: "A == 2"},
+    },
+    tasks: []string{"A=1"},
+  }, {
+    name: "undeclared parameter",
+    params: []JobParam{{Name: "A", Type: "int", Only: []string{"1"}, Params: []JobParam{
+      {Name: "SUB", Type: "int", Only: []string{"1"}, When: "AA > 1"},
+    }}},
+    err: "references AA",
+  }, {
+    name: "parameter declared after the condition",
+    params: []JobParam{
+      {Name: "A", Type: "int", Only: []string{"1"}, When: "B > 1"},
+      {Name: "B", Type: "int", Only: []string{"2"}},
+    },
+    err: "references B",
+  }, {
+    name: "condition on itself",
+    params: []JobParam{
+      {Name: "A", Type: "int", Only: []string{"1"}, When: "A > 1"},
+    },
+    err: "references A",
+  }, {
+    name: "bare word without a parent",
+    params: []JobParam{{Name: "A", Type: "int", Only: []string{"1"}, When: "y"}},
+    err: "it has none",
+  }, {
+    name: "bare word under a zip group",
+    params: []JobParam{{
+      Zip:    []JobParam{{Name: "A", Type: "int", Only: []string{"1"}}},
+      Params: []JobParam{{Name: "B", Type: "int", Only: []string{"1"}, When: "1"}},
+    }},
+    err: "compares with a zip group",
+  }, {
+    name: "invalid expression",
+    params: []JobParam{
+      {Name: "A", Type: "int", Only: []string{"1"}},
+      {Name: "B", Type: "int", Only: []string{"1"}, When: "A >"},
+    },
+    err: "Invalid condition",
+  }}
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      j := &Job{Params: test.params}
+      tasks, err := j.tasks()
+      if len(test.err) > 0 {
+        if err == nil || !strings.Contains(err.Error(), test.err) {
+          t.Fatalf("expected error %q, got %v", test.err, err)
+        }
+        return
+      } else if err != nil {
+        t.Fatal(err)
+      }
+
+      if got := taskStrings(tasks); !reflect.DeepEqual(got, test.tasks) {
+        t.Errorf("expected %q, got %q", test.tasks, got)
+      }
+    })
+  }
+}
+
+func TestDuplicateParams(t *testing.T) {
+  a := func(sub ...JobParam) JobParam {
+    return JobParam{Name: "A", Type: "int", Only: []string{"1"}, Params: sub}
+  }
+  b := func(sub ...JobParam) JobParam {
+    return JobParam{Name: "B", Type: "int", Only: []string{"1"}, Params: sub}
+  }
+
+  c := JobParam{Name: "C", Type: "int", Only: []string{"1"}}
+
+  tests := []struct {
+    name   string
+    params []JobParam
+    err    string
+  }{
+    {"distinct", []JobParam{a(b())}, ""},
+    {"siblings", []JobParam{a(), a()}, "Duplicate parameter: A"},
+    {"ancestor", []JobParam{a(b(a()))}, "Duplicate parameter: A"},
+    {"cousins", []JobParam{a(c), b(c)}, "Duplicate parameter: C"},
+    {"sub-parameter and root", []JobParam{a(b()), b()}, "Duplicate parameter: B"},
+    {"zip members", []JobParam{{Zip: []JobParam{a(), a()}}}, "Duplicate parameter: A"},
+    {"zip member and root", []JobParam{{Zip: []JobParam{a(), b()}}, b()}, "Duplicate parameter: B"},
+    {"missing name", []JobParam{{Type: "int"}}, "missing a name"},
+  }
+
+  for _, test := range tests {
+    j := &Job{Params: test.params}
+    _, err := j.tasks()
+    if len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)) {
+      t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+    } else if len(test.err) == 0 && err != nil {
+      t.Errorf("%s: %s", test.name, err)
+    }
+  }
+}
+
+func TestDerived(t *testing.T) {
+  params := []JobParam{
+    {Name: "A", Type: "int", Only: []string{"0", "2"}, Params: []JobParam{
+      {Name: "SUB", Type: "int", Only: []string{"3"}, When: "A > 0"},
+    }},
+    {Name: "S", Type: "string", Only: []string{"x"}},
+  }
+
+  tests := []struct {
+    name        string
+    derived     []DerivedParam
+    constraints []string
+    values      []string
+    err         string
+  }{{
+    name:    "expression",
+    derived: []DerivedParam{{Name: "D", Expr: "A * 2 + 1"}},
+    values:  []string{"D=1", "D=5"},
+  }, {
+    name:    "template",
+    derived: []DerivedParam{{Name: "D", Template: "${S}-${A}"}},
+    values:  []string{"D=x-0", "D=x-2"},
+  }, {
+    name: "in order",
+    derived: []DerivedParam{
+      {Name: "D", Expr: "A + 1"},
+      {Name: "E", Template: "${D}${D}"},
+      {Name: "F", Expr: "E > 20"},
+    },
+    values: []string{"D=1 E=11 F=false", "D=3 E=33 F=true"},
+  }, {
+    name: "inactive parameter",
+    derived: []DerivedParam{
+      {Name: "D", Expr: "SUB * 2"},
+      {Name: "E", Template: "${SUB}"},
+      {Name: "F", Expr: "D + 1"},
+    },
+    values: []string{"", "D=6 E=3 F=7"},
+  }, {
+    name:        "used by constraints",
+    derived:     []DerivedParam{{Name: "D", Expr: "A + 1"}},
+    constraints: []string{"D > 1"},
+    values:      []string{"D=3"},
+  }, {
+    name:        "error in an excluded permutation",
+    derived:     []DerivedParam{{Name: "D", Expr: "4 / A"}},
+    constraints: []string{"A != 0"},
+    values:      []string{"D=2"},
+  }, {
+    name:    "error in an included permutation",
+    derived: []DerivedParam{{Name: "D", Expr: "4 / A"}},
+    err:     "Could not derive D: Division by zero",
+  }, {
+    name:    "unknown parameter in an expression",
+    derived: []DerivedParam{{Name: "D", Expr: "AA + 1"}},
+    err:     "D references unknown parameter: AA",
+  }, {
+    name:    "unknown parameter in a template",
+    derived: []DerivedParam{{Name: "D", Template: "${A}-${SS}"}},
+    err:     "D references unknown parameter: SS",
+  }, {
+    name: "later derived parameter",
+    derived: []DerivedParam{
+      {Name: "D", Expr: "E + 1"},
+      {Name: "E", Expr: "A"},
+    },
+    err: "D references unknown parameter: E",
+  }, {
+    name:    "itself",
+    derived: []DerivedParam{{Name: "D", Template: "${D}"}},
+    err:     "D references unknown parameter: D",
+  }, {
+    name:    "name of a parameter",
+    derived: []DerivedParam{{Name: "A", Expr: "1"}},
+    err:     "already a parameter",
+  }, {
+    name:    "both expression and template",
+    derived: []DerivedParam{{Name: "D", Expr: "1", Template: "1"}},
+    err:     "either expr or template",
+  }}
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      j := &Job{
+        Params:      params,
+        Derived:     append([]DerivedParam{}, test.derived...),
+        Constraints: test.constraints,
+      }
+
+      tasks, err := j.tasks()
+      if len(test.err) > 0 {
+        if err == nil || !strings.Contains(err.Error(), test.err) {
+          t.Fatalf("expected error %q, got %v", test.err, err)
+        }
+        return
+      } else if err != nil {
+        t.Fatal(err)
+      }
+
+      var values []string
+      for _, task := range tasks {
+        var derived []string
+        for _, p := range task.Derived {
+          derived = append(derived, p.Name+"="+p.Value)
+        }
+        values = append(values, strings.Join(derived, " "))
+      }
+
+      if !reflect.DeepEqual(values, test.values) {
+        t.Errorf("expected %q, got %q", test.values, values)
+      }
+    })
+  }
+}
+
+func TestConcurrentRuns(t *testing.T) {
+  isolated := func(name string, cores int, concurrent bool) run.Run {
+    return run.Run{
+      Name:       name,
+      Cmd:        "true",
+      Cores:      cores,
+      Network:    run.NetworkIsolated,
+      Concurrent: concurrent,
+    }
+  }
+
+  tests := []struct {
+    name    string
+    runs    []run.Run
+    outputs []run.Output
+    cores   []int
+    err     string
+  }{{
+    name:  "sequential",
+    runs:  []run.Run{isolated("a", 1, false), isolated("b", 2, false)},
+    cores: []int{1, 2},
+  }, {
+    name: "groups",
+    runs: []run.Run{
+      isolated("build", 4, false),
+      isolated("server", 2, false),
+      isolated("client", 1, true),
+      isolated("load", 3, true),
+      isolated("report", 1, false),
+    },
+    cores: []int{4, 6, 4, 3, 1},
+  }, {
+    name: "outputs of earlier groups",
+    runs: []run.Run{isolated("a", 1, false), isolated("b", 1, false), isolated("c", 1, true)},
+    outputs: []run.Output{{Path: "/out", Producer: "a", Consumers: []string{"c"}}},
+    cores: []int{1, 2, 1},
+  }, {
+    name: "first run",
+    runs: []run.Run{isolated("a", 1, true)},
+    err:  "no run before it",
+  }, {
+    name: "bridged",
+    runs: []run.Run{isolated("a", 1, false), {Name: "b", Cmd: "true", Concurrent: true}},
+    err:  "must use the isolated network",
+  }, {
+    name: "after a bridged run",
+    runs: []run.Run{{Name: "a", Cmd: "true"}, isolated("b", 1, true)},
+    err:  "must use the isolated network",
+  }, {
+    name: "outputs within a group",
+    runs: []run.Run{isolated("a", 1, false), isolated("b", 1, true)},
+    outputs: []run.Output{{Path: "/out", Producer: "a", Consumers: []string{"b"}}},
+    err:  "produced by run a alongside it",
+  }}
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      j := &Job{Runs: test.runs, Outputs: test.outputs}
+      err := j.checkRuns(nil)
+      if len(test.err) > 0 {
+        if err == nil || !strings.Contains(err.Error(), test.err) {
+          t.Fatalf("expected error %q, got %v", test.err, err)
+        }
+        return
+      } else if err != nil {
+        t.Fatal(err)
+      }
+
+      var cores []int
+      for _, r := range j.Runs {
+        cores = append(cores, j.groupCores(r.Name))
+      }
+
+      if !reflect.DeepEqual(cores, test.cores) {
+        t.Errorf("expected cores %v, got %v", test.cores, cores)
+      }
+    })
+  }
+}
+
+func TestParamTypes(t *testing.T) {
+  tests := []struct {
+    param  JobParam
+    values []string
+    err    string
+  }{
+    // Sizes are rendered in bytes
+    {JobParam{Type: "size", Only: []string{"512", "4K", "1MiB", "2 GB"}}, []string{"512", "4096", "1048576", "2147483648"}, ""},
+    {JobParam{Type: "size", Default: "64k"}, []string{"65536"}, ""},
+    {JobParam{Type: "size", Min: "0", Max: "2M", Step: "1M"}, []string{"0", "1048576", "2097152"}, ""},
+    {JobParam{Type: "size", Min: "1K", Max: "8K", StepMode: "multiply", Step: "2"}, []string{"1024", "2048", "4096", "8192"}, ""},
+    {JobParam{Type: "size", Min: "0", Max: "1K", StepMode: "linspace", Count: "3"}, []string{"0", "512", "1024"}, ""},
+    {JobParam{Type: "size", Only: []string{"-1K"}}, nil, "Invalid value"},
+    {JobParam{Type: "size", Only: []string{"1X"}}, nil, "Invalid value"},
+    {JobParam{Type: "size", Min: "1K", Max: "huge"}, nil, "Invalid max"},
+
+    // Floats are swept without accumulating rounding errors
+    {JobParam{Type: "float", Only: []string{"0.5", "1e3"}}, []string{"0.5", "1e3"}, ""},
+    {JobParam{Type: "float", Min: "0.1", Max: "0.3", Step: "0.1"}, []string{"0.1", "0.2", "0.3"}, ""},
+    {JobParam{Type: "float", Min: "1", Max: "0"}, nil, "Min can't be greater than max"},
+    {JobParam{Type: "float", Only: []string{"half"}}, nil, "Invalid float"},
+
+    // Booleans are swept across both values
+    {JobParam{Type: "bool"}, []string{"true", "false"}, ""},
+    {JobParam{Type: "boolean", Only: []string{"false"}}, []string{"false"}, ""},
+    {JobParam{Type: "bool", Only: []string{"1", "F"}}, []string{"true", "false"}, ""},
+    {JobParam{Type: "bool", TrueValue: "y", FalseValue: "n"}, []string{"y", "n"}, ""},
+    {JobParam{Type: "bool", TrueValue: "y", FalseValue: "n", Only: []string{"n", "true"}}, []string{"n", "y"}, ""},
+    {JobParam{Type: "bool", Only: []string{"maybe"}}, nil, "Invalid bool"},
+  }
+
+  for _, test := range tests {
+    test.param.Name = "P"
+    values, err := paramPermutations(&test.param)
+    if len(test.err) > 0 {
+      if err == nil || !strings.Contains(err.Error(), test.err) {
+        t.Errorf("%+v: expected error %q, got %v", test.param, test.err, err)
+      }
+      continue
+    } else if err != nil {
+      t.Errorf("%+v: %s", test.param, err)
+      continue
+    }
+
+    var got []string
+    for _, v := range values {
+      got = append(got, v.Value)
+    }
+
+    if !reflect.DeepEqual(got, test.values) {
+      t.Errorf("%+v: expected %v, got %v", test.param, test.values, got)
+    }
+  }
+}
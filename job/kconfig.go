@@ -0,0 +1,522 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "os"
+  "fmt"
+  "path"
+  "bufio"
+  "strings"
+  "strconv"
+  "path/filepath"
+
+  "github.com/lancs-net/wayfinder/log"
+)
+
+// KconfigSource generates parameters from the symbols of a Kconfig tree or of
+// a `.config`/`defconfig` file, rather than listing each of them by hand
+type KconfigSource struct {
+  File    string   `yaml:"file" schema:"required"`
+  Symbols []string `yaml:"symbols"`
+  Menu    string   `yaml:"menu"`
+  Count   string   `yaml:"count"`
+}
+
+// kconfigSymbol is a symbol as read from a Kconfig or .config file
+type kconfigSymbol struct {
+  name    string
+  kind    string
+  def     string
+  min     string
+  max     string
+  menus []string
+  options []string // of a choice
+}
+
+// importKconfig replaces the parameters which have a kconfig source, including
+// sub-parameters, with a parameter for each of the selected symbols.  Paths
+// are relative to the directory of the job file.
+func importKconfig(params []JobParam, dir string) ([]JobParam, error) {
+  var imported []JobParam
+
+  for _, param := range params {
+    var err error
+    param.Params, err = importKconfig(param.Params, dir)
+    if err != nil {
+      return nil, err
+    }
+
+    if param.Kconfig == nil {
+      imported = append(imported, param)
+      continue
+    }
+
+    if len(param.Name) > 0 || len(param.Type) > 0 || len(param.Zip) > 0 ||
+       len(param.Params) > 0 {
+      return nil, fmt.Errorf(
+        "Kconfig source %s cannot have a name, type, zip or params",
+        param.Kconfig.File,
+      )
+    }
+
+    generated, err := param.Kconfig.params(dir)
+    if err != nil {
+      return nil, err
+    }
+
+    // The condition of the source applies to each of its symbols
+    for i := range generated {
+      generated[i].When = param.When
+    }
+
+    imported = append(imported, generated...)
+  }
+
+  return imported, nil
+}
+
+// params reads the source and returns a parameter for each selected symbol
+func (k *KconfigSource) params(dir string) ([]JobParam, error) {
+  if len(k.Symbols) == 0 && len(k.Menu) == 0 {
+    return nil, fmt.Errorf(
+      "Kconfig source %s must select symbols or a menu", k.File,
+    )
+  }
+
+  count := 0
+  if len(k.Count) > 0 {
+    var err error
+    count, err = strconv.Atoi(k.Count)
+    if err != nil || count < 1 {
+      return nil, fmt.Errorf("Invalid count for %s: %s", k.File, k.Count)
+    }
+  }
+
+  file := k.File
+  if !filepath.IsAbs(file) {
+    file = filepath.Join(dir, file)
+  }
+
+  isConfig, err := isDotConfig(file)
+  if err != nil {
+    return nil, err
+  }
+
+  var symbols []*kconfigSymbol
+  if isConfig {
+    if len(k.Menu) > 0 {
+      return nil, fmt.Errorf("Menus can only be selected from a Kconfig: %s", k.File)
+    }
+    symbols, err = parseDotConfig(file)
+  } else {
+    symbols, err = parseKconfig(filepath.Dir(file), file, nil, nil)
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  var params []JobParam
+  for _, sym := range symbols {
+    ok, err := k.selects(sym)
+    if err != nil {
+      return nil, err
+    } else if !ok {
+      continue
+    }
+
+    param, ok := sym.param(count)
+    if !ok {
+      log.Warnf("Skipping Kconfig symbol %s of type %s", sym.name, sym.kind)
+      continue
+    }
+
+    params = append(params, param)
+  }
+
+  if len(params) == 0 {
+    return nil, fmt.Errorf("No symbols selected from %s", k.File)
+  }
+
+  log.Debugf("Imported %d parameters from %s", len(params), k.File)
+
+  return params, nil
+}
+
+// selects returns whether a symbol matches one of the globs and the menu
+func (k *KconfigSource) selects(sym *kconfigSymbol) (bool, error) {
+  if len(k.Menu) > 0 {
+    found := false
+    for _, menu := range sym.menus {
+      ok, err := path.Match(k.Menu, menu)
+      if err != nil {
+        return false, fmt.Errorf("Invalid menu pattern: %s", k.Menu)
+      }
+      found = found || ok
+    }
+
+    if !found {
+      return false, nil
+    }
+  }
+
+  if len(k.Symbols) == 0 {
+    return true, nil
+  }
+
+  // A choice is selected by its name or by any of its options
+  for _, glob := range k.Symbols {
+    for _, name := range append([]string{sym.name}, sym.options...) {
+      ok, err := path.Match(strings.TrimPrefix(glob, "CONFIG_"), name)
+      if err != nil {
+        return false, fmt.Errorf("Invalid symbol pattern: %s", glob)
+      } else if ok {
+        return true, nil
+      }
+    }
+  }
+
+  return false, nil
+}
+
+// param returns the parameter of a symbol.  Booleans are swept across both
+// values, tristates across all three, choices across their options and
+// integers with a range across count values; other symbols take their default
+// value.
+func (sym *kconfigSymbol) param(count int) (JobParam, bool) {
+  param := JobParam{
+    Name:    sym.name,
+    Default: sym.def,
+  }
+
+  switch sym.kind {
+  case "bool":
+    param.Type = "bool"
+    param.TrueValue = "y"
+    param.FalseValue = "n"
+    param.Default = ""
+
+  case "tristate":
+    param.Type = "string"
+    param.Only = []string{"y", "m", "n"}
+
+  case "choice":
+    param.Type = "choice"
+    param.Only = sym.options
+    param.Default = ""
+
+  case "int":
+    param.Type = "integer"
+    if count > 0 && isInt(sym.min) && isInt(sym.max) {
+      param.Min = sym.min
+      param.Max = sym.max
+      param.StepMode = "linspace"
+      param.Count = strconv.Itoa(count)
+    }
+
+  case "hex", "string":
+    param.Type = "string"
+
+  default:
+    return param, false
+  }
+
+  // Parameters without values would otherwise not be part of any task
+  if param.Type != "bool" && len(param.Only) == 0 && len(param.Min) == 0 &&
+     len(param.Default) == 0 {
+    return param, false
+  }
+
+  return param, true
+}
+
+// isDotConfig returns whether a file is a `.config` rather than a Kconfig, by
+// looking at its first statement
+func isDotConfig(file string) (bool, error) {
+  f, err := os.Open(file)
+  if err != nil {
+    return false, err
+  }
+
+  defer f.Close()
+
+  scanner := bufio.NewScanner(f)
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+    if strings.HasPrefix(line, "CONFIG_") ||
+       (strings.HasPrefix(line, "# CONFIG_") && strings.HasSuffix(line, " is not set")) {
+      return true, nil
+    } else if len(line) > 0 && !strings.HasPrefix(line, "#") {
+      return false, nil
+    }
+  }
+
+  return false, scanner.Err()
+}
+
+// parseDotConfig reads the symbols of a `.config` file.  Their types are
+// inferred from their values.
+func parseDotConfig(file string) ([]*kconfigSymbol, error) {
+  f, err := os.Open(file)
+  if err != nil {
+    return nil, err
+  }
+
+  defer f.Close()
+
+  var symbols []*kconfigSymbol
+  scanner := bufio.NewScanner(f)
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+
+    if strings.HasPrefix(line, "# CONFIG_") && strings.HasSuffix(line, " is not set") {
+      name := strings.TrimSuffix(strings.TrimPrefix(line, "# CONFIG_"), " is not set")
+      symbols = append(symbols, &kconfigSymbol{name: name, kind: "bool", def: "n"})
+      continue
+    } else if !strings.HasPrefix(line, "CONFIG_") {
+      continue
+    }
+
+    kv := strings.SplitN(strings.TrimPrefix(line, "CONFIG_"), "=", 2)
+    if len(kv) != 2 {
+      continue
+    }
+
+    sym := &kconfigSymbol{name: kv[0], def: kv[1]}
+    switch {
+    case sym.def == "y" || sym.def == "n":
+      sym.kind = "bool"
+    case sym.def == "m":
+      sym.kind = "tristate"
+    case strings.HasPrefix(sym.def, "0x"):
+      sym.kind = "hex"
+    case strings.HasPrefix(sym.def, "\""):
+      sym.kind = "string"
+      sym.def = unquote(sym.def)
+    case isInt(sym.def):
+      sym.kind = "int"
+    default:
+      sym.kind = "string"
+    }
+
+    symbols = append(symbols, sym)
+  }
+
+  return symbols, scanner.Err()
+}
+
+// parseKconfig reads the symbols of a Kconfig file and of the files it
+// sources, along with the menus they are declared in.  The options of a choice
+// are returned as a single symbol.  Files are sourced relative to the root of
+// the tree, or relative to the current file by `rsource` and `orsource`.
+func parseKconfig(root, file string, menus []string, seen map[string]bool) ([]*kconfigSymbol, error) {
+  if seen == nil {
+    seen = make(map[string]bool)
+  } else if seen[file] {
+    return nil, nil
+  }
+  seen[file] = true
+
+  f, err := os.Open(file)
+  if err != nil {
+    return nil, err
+  }
+
+  defer f.Close()
+
+  var symbols []*kconfigSymbol
+  var sym, choice *kconfigSymbol
+  help := -1
+
+  scanner := bufio.NewScanner(f)
+  for scanner.Scan() {
+    raw := scanner.Text()
+    line := strings.TrimSpace(raw)
+
+    // Help text continues for as long as it is indented more than its keyword
+    if help >= 0 {
+      if len(line) == 0 || indent(raw) > help {
+        continue
+      }
+      help = -1
+    }
+
+    if len(line) == 0 || strings.HasPrefix(line, "#") {
+      continue
+    }
+
+    fields := strings.Fields(line)
+    switch keyword := fields[0]; keyword {
+    case "config", "menuconfig":
+      sym = nil
+      if len(fields) > 1 {
+        sym = &kconfigSymbol{
+          name:  fields[1],
+          menus: append([]string{}, menus...),
+        }
+
+        // Options are only set through their choice
+        if choice != nil {
+          choice.options = append(choice.options, sym.name)
+        } else {
+          symbols = append(symbols, sym)
+        }
+      }
+
+    case "choice":
+      choice = &kconfigSymbol{
+        kind:  "choice",
+        menus: append([]string{}, menus...),
+      }
+      if len(fields) > 1 {
+        choice.name = fields[1]
+      }
+      sym = choice
+      symbols = append(symbols, choice)
+
+    case "endchoice":
+      // Anonymous choices are named after their first option
+      if choice != nil && len(choice.name) == 0 && len(choice.options) > 0 {
+        choice.name = "CHOICE_" + choice.options[0]
+      }
+      sym = nil
+      choice = nil
+
+    case "bool", "tristate", "int", "hex", "string":
+      if sym != nil && sym != choice {
+        sym.kind = keyword
+      }
+
+    case "def_bool", "def_tristate":
+      if sym != nil && sym != choice {
+        sym.kind = strings.TrimPrefix(keyword, "def_")
+        if len(sym.def) == 0 && len(fields) > 1 {
+          sym.def = unquote(fields[1])
+        }
+      }
+
+    case "default":
+      // Only the first default applies when its condition is not evaluated
+      if sym != nil && len(sym.def) == 0 && len(fields) > 1 {
+        sym.def = unquote(fields[1])
+      }
+
+    case "range":
+      if sym != nil && len(fields) > 2 {
+        sym.min = fields[1]
+        sym.max = fields[2]
+      }
+
+    case "help", "---help---":
+      help = indent(raw)
+
+    case "menu":
+      sym = nil
+      menus = append(menus, unquote(strings.TrimSpace(strings.TrimPrefix(line, "menu"))))
+
+    case "endmenu":
+      sym = nil
+      if len(menus) > 0 {
+        menus = menus[:len(menus)-1]
+      }
+
+    case "source", "rsource", "osource", "orsource":
+      sym = nil
+      if len(fields) < 2 {
+        continue
+      }
+
+      // Sourced files cannot be resolved when their path depends on variables
+      // of the build system
+      target := unquote(fields[1])
+      if strings.Contains(target, "$") {
+        log.Warnf("Cannot resolve Kconfig source in %s: %s", file, target)
+        continue
+      } else if !filepath.IsAbs(target) {
+        dir := root
+        if keyword == "rsource" || keyword == "orsource" {
+          dir = filepath.Dir(file)
+        }
+        target = filepath.Join(dir, target)
+      }
+
+      matches, err := filepath.Glob(target)
+      if err != nil {
+        return nil, err
+      } else if len(matches) == 0 && keyword != "osource" && keyword != "orsource" {
+        return nil, fmt.Errorf("Kconfig %s sources missing file: %s", file, target)
+      }
+
+      for _, match := range matches {
+        sourced, err := parseKconfig(root, match, menus, seen)
+        if err != nil {
+          return nil, err
+        }
+        symbols = append(symbols, sourced...)
+      }
+
+    case "if", "endif", "comment", "mainmenu":
+      sym = nil
+    }
+  }
+
+  return symbols, scanner.Err()
+}
+
+// indent returns the width of the leading whitespace of a line
+func indent(line string) int {
+  width := 0
+  for _, c := range line {
+    switch c {
+    case ' ':
+      width++
+    case '\t':
+      width += 8 - width%8
+    default:
+      return width
+    }
+  }
+  return width
+}
+
+// isInt returns whether a value is a decimal integer rather than a symbol
+func isInt(s string) bool {
+  _, err := strconv.Atoi(s)
+  return err == nil
+}
+
+// unquote removes the double quotes around a Kconfig string
+func unquote(s string) string {
+  if len(s) >= 2 && strings.HasPrefix(s, "\"") && strings.HasSuffix(s, "\"") {
+    return s[1:len(s)-1]
+  }
+  return s
+}
@@ -0,0 +1,319 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "os"
+  "reflect"
+  "strings"
+  "testing"
+  "io/ioutil"
+  "path/filepath"
+)
+
+// writeTree writes the files of a Kconfig tree to a temporary directory
+func writeTree(t *testing.T, files map[string]string) string {
+  dir, err := ioutil.TempDir("", "kconfig")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  for name, content := range files {
+    file := filepath.Join(dir, name)
+    err = os.MkdirAll(filepath.Dir(file), 0755)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    err = ioutil.WriteFile(file, []byte(content), 0644)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  return dir
+}
+
+func TestParseKconfig(t *testing.T) {
+  tests := []struct {
+    name    string
+    files   map[string]string
+    symbols []kconfigSymbol
+    err     string
+  }{{
+    name: "types, defaults and ranges",
+    files: map[string]string{
+      "Kconfig": `
+config A
+	bool "A"
+	default y
+	help
+	  config NOT_A_SYMBOL
+	  int
+
+config B
+	int
+	range 1 8
+	default 4
+
+config C
+	def_tristate m
+`,
+    },
+    symbols: []kconfigSymbol{
+      {name: "A", kind: "bool", def: "y"},
+      {name: "B", kind: "int", def: "4", min: "1", max: "8"},
+      {name: "C", kind: "tristate", def: "m"},
+    },
+  }, {
+    name: "menus",
+    files: map[string]string{
+      "Kconfig": `
+menu "Outer"
+config A
+	bool
+menu "Inner"
+config B
+	bool
+endmenu
+endmenu
+config C
+	bool
+`,
+    },
+    symbols: []kconfigSymbol{
+      {name: "A", kind: "bool", menus: []string{"Outer"}},
+      {name: "B", kind: "bool", menus: []string{"Outer", "Inner"}},
+      {name: "C", kind: "bool"},
+    },
+  }, {
+    name: "source is relative to the root",
+    files: map[string]string{
+      "Kconfig":       `source "lib/Kconfig"`,
+      "lib/Kconfig":   `source "lib/a/Kconfig"`,
+      "lib/a/Kconfig": "config A\n\tbool\n",
+    },
+    symbols: []kconfigSymbol{{name: "A", kind: "bool"}},
+  }, {
+    name: "rsource is relative to the file",
+    files: map[string]string{
+      "Kconfig":       `source "lib/Kconfig"`,
+      "lib/Kconfig":   `rsource "a/Kconfig"`,
+      "lib/a/Kconfig": "config A\n\tbool\n",
+    },
+    symbols: []kconfigSymbol{{name: "A", kind: "bool"}},
+  }, {
+    name: "source globs",
+    files: map[string]string{
+      "Kconfig":   `source "*/Kconfig"`,
+      "a/Kconfig": "config A\n\tbool\n",
+      "b/Kconfig": "config B\n\tbool\n",
+    },
+    symbols: []kconfigSymbol{{name: "A", kind: "bool"}, {name: "B", kind: "bool"}},
+  }, {
+    name: "missing source",
+    files: map[string]string{
+      "Kconfig":     `source "lib/Kconfig"`,
+      "lib/Kconfig": `source "a/Kconfig"`,
+      "lib/a/Kconfig": "config A\n\tbool\n",
+    },
+    err: "sources missing file",
+  }, {
+    name: "missing optional sources",
+    files: map[string]string{
+      "Kconfig": "osource \"a/Kconfig\"\norsource \"b/Kconfig\"\nsource \"$(SRCARCH)/Kconfig\"\nconfig A\n\tbool\n",
+    },
+    symbols: []kconfigSymbol{{name: "A", kind: "bool"}},
+  }, {
+    name: "choices",
+    files: map[string]string{
+      "Kconfig": `
+choice
+	prompt "Allocator"
+	default ALLOC_B
+config ALLOC_A
+	bool "A"
+config ALLOC_B
+	bool "B"
+endchoice
+
+choice SCHED
+	bool "Scheduler"
+config SCHED_RR
+	bool "RR"
+config SCHED_FIFO
+	bool "FIFO"
+endchoice
+
+config C
+	bool
+`,
+    },
+    symbols: []kconfigSymbol{
+      {name: "CHOICE_ALLOC_A", kind: "choice", def: "ALLOC_B", options: []string{"ALLOC_A", "ALLOC_B"}},
+      {name: "SCHED", kind: "choice", options: []string{"SCHED_RR", "SCHED_FIFO"}},
+      {name: "C", kind: "bool"},
+    },
+  }}
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      dir := writeTree(t, test.files)
+      defer os.RemoveAll(dir)
+
+      symbols, err := parseKconfig(dir, filepath.Join(dir, "Kconfig"), nil, nil)
+      if len(test.err) > 0 {
+        if err == nil || !strings.Contains(err.Error(), test.err) {
+          t.Fatalf("expected error %q, got %v", test.err, err)
+        }
+        return
+      } else if err != nil {
+        t.Fatal(err)
+      }
+
+      var got []kconfigSymbol
+      for _, sym := range symbols {
+        if len(sym.menus) == 0 {
+          sym.menus = nil
+        }
+        got = append(got, *sym)
+      }
+
+      if !reflect.DeepEqual(got, test.symbols) {
+        t.Errorf("expected %+v, got %+v", test.symbols, got)
+      }
+    })
+  }
+}
+
+func TestParseDotConfig(t *testing.T) {
+  dir := writeTree(t, map[string]string{
+    ".config": `#
+# Automatically generated file; DO NOT EDIT.
+#
+CONFIG_A=y
+# CONFIG_B is not set
+CONFIG_C=m
+CONFIG_D=64
+CONFIG_E=0x1000
+CONFIG_F="quoted"
+CONFIG_G=unquoted
+`,
+  })
+  defer os.RemoveAll(dir)
+
+  file := filepath.Join(dir, ".config")
+  isConfig, err := isDotConfig(file)
+  if err != nil {
+    t.Fatal(err)
+  } else if !isConfig {
+    t.Fatalf("%s is not detected as a .config", file)
+  }
+
+  symbols, err := parseDotConfig(file)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  expected := []kconfigSymbol{
+    {name: "A", kind: "bool", def: "y"},
+    {name: "B", kind: "bool", def: "n"},
+    {name: "C", kind: "tristate", def: "m"},
+    {name: "D", kind: "int", def: "64"},
+    {name: "E", kind: "hex", def: "0x1000"},
+    {name: "F", kind: "string", def: "quoted"},
+    {name: "G", kind: "string", def: "unquoted"},
+  }
+
+  var got []kconfigSymbol
+  for _, sym := range symbols {
+    got = append(got, *sym)
+  }
+
+  if !reflect.DeepEqual(got, expected) {
+    t.Errorf("expected %+v, got %+v", expected, got)
+  }
+}
+
+func TestIsDotConfig(t *testing.T) {
+  dir := writeTree(t, map[string]string{
+    "Kconfig": "# CONFIG_A is a comment\nconfig A\n\tbool\n",
+    "defconfig": "\n# CONFIG_A is not set\n",
+  })
+  defer os.RemoveAll(dir)
+
+  tests := map[string]bool{"Kconfig": false, "defconfig": true}
+  for name, expected := range tests {
+    isConfig, err := isDotConfig(filepath.Join(dir, name))
+    if err != nil {
+      t.Fatal(err)
+    } else if isConfig != expected {
+      t.Errorf("%s: expected %v, got %v", name, expected, isConfig)
+    }
+  }
+}
+
+func TestKconfigChoiceParam(t *testing.T) {
+  sym := &kconfigSymbol{
+    name:    "SCHED",
+    kind:    "choice",
+    def:     "SCHED_FIFO",
+    options: []string{"SCHED_RR", "SCHED_FIFO"},
+  }
+
+  param, ok := sym.param(0)
+  if !ok {
+    t.Fatal("choice was skipped")
+  }
+
+  values, err := paramPermutations(&param)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var got []string
+  for _, v := range values {
+    got = append(got, v.Value)
+  }
+
+  if !reflect.DeepEqual(got, sym.options) {
+    t.Errorf("expected %v, got %v", sym.options, got)
+  }
+
+  // Selecting an option selects its choice
+  k := &KconfigSource{Symbols: []string{"CONFIG_SCHED_RR"}}
+  selected, err := k.selects(sym)
+  if err != nil {
+    t.Fatal(err)
+  } else if !selected {
+    t.Error("choice is not selected by its option")
+  }
+}
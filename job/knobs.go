@@ -0,0 +1,151 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "fmt"
+  "sync"
+
+  "github.com/lancs-net/wayfinder/log"
+)
+
+// hostKnobs tracks the values of host knobs which are bound to parameters of
+// tasks in flight.  Since knobs are global to the host, tasks which require a
+// different value of the same knob must never run in parallel.
+type hostKnobs struct {
+  sync.Mutex
+  values  map[string]string          // value applied to each knob
+  before  map[string]string          // value of each knob prior to the tasks
+  holders map[string]map[string]bool // tasks holding each knob
+}
+
+// newHostKnobs prepares an empty set of knobs
+func newHostKnobs() *hostKnobs {
+  return &hostKnobs{
+    values:  make(map[string]string),
+    before:  make(map[string]string),
+    holders: make(map[string]map[string]bool),
+  }
+}
+
+// knobs returns the host knobs bound to the task's parameters
+func (t *Task) knobs() map[string]string {
+  knobs := make(map[string]string)
+  for _, param := range t.Params {
+    if len(param.Host) > 0 {
+      knobs[param.Host] = param.Value
+    }
+  }
+
+  return knobs
+}
+
+// Acquire applies the task's host knobs if they do not conflict with the knobs
+// of other tasks in flight.  It returns false if the task must wait.
+func (hk *hostKnobs) Acquire(task *Task, dryRun bool) (bool, error) {
+  knobs := task.knobs()
+  if len(knobs) == 0 {
+    return true, nil
+  }
+
+  hk.Lock()
+  defer hk.Unlock()
+
+  // Check all knobs before changing any of them
+  for knob, value := range knobs {
+    if len(hk.holders[knob]) > 0 && hk.values[knob] != value {
+      return false, nil
+    }
+  }
+
+  var acquired []string
+  for _, knob := range sortedKeys(knobs) {
+    if hk.holders[knob][task.UUID()] {
+      continue
+    }
+
+    if len(hk.holders[knob]) == 0 {
+      before, err := readProcfsValue(knob)
+      if err == nil {
+        err = setProcfsValue(knob, knobs[knob], dryRun)
+      }
+      if err != nil {
+        hk.release(task, acquired, dryRun)
+        return false, fmt.Errorf("Could not set host knob: %s", err)
+      }
+
+      hk.before[knob] = before
+      hk.values[knob] = knobs[knob]
+      hk.holders[knob] = make(map[string]bool)
+    }
+
+    hk.holders[knob][task.UUID()] = true
+    acquired = append(acquired, knob)
+  }
+
+  return true, nil
+}
+
+// Release the task's host knobs, restoring those no longer held by any task
+func (hk *hostKnobs) Release(task *Task, dryRun bool) {
+  var knobs []string
+  for knob := range task.knobs() {
+    knobs = append(knobs, knob)
+  }
+
+  hk.Lock()
+  defer hk.Unlock()
+
+  hk.release(task, knobs, dryRun)
+}
+
+// release must be called with the lock held
+func (hk *hostKnobs) release(task *Task, knobs []string, dryRun bool) {
+  for _, knob := range knobs {
+    if !hk.holders[knob][task.UUID()] {
+      continue
+    }
+
+    delete(hk.holders[knob], task.UUID())
+    if len(hk.holders[knob]) > 0 {
+      continue
+    }
+
+    err := setProcfsValue(knob, hk.before[knob], dryRun)
+    if err != nil {
+      log.Warnf("Could not restore host knob: %s", err)
+    }
+
+    delete(hk.holders, knob)
+    delete(hk.values, knob)
+    delete(hk.before, knob)
+  }
+}
@@ -0,0 +1,190 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "fmt"
+  "net"
+  "os"
+  "path"
+  "sync"
+  "encoding/binary"
+
+  "github.com/vishvananda/netlink"
+
+  "github.com/lancs-net/wayfinder/log"
+  "github.com/lancs-net/wayfinder/run"
+)
+
+// isolatedBridges holds onto the private bridges of tasks with runs using the
+// isolated network mode.  Each bridge is given a /24 from the isolated subnet.
+type isolatedBridges struct {
+  sync.Mutex
+  subnet  *net.IPNet
+  slots  []string               // task UUID occupying each /24
+  bridges map[string]*run.Bridge // bridges indexed by task UUID
+}
+
+// newIsolatedBridges prepares the pool of private bridges from a subnet
+func newIsolatedBridges(subnet string) (*isolatedBridges, error) {
+  _, ipNet, err := net.ParseCIDR(subnet)
+  if err != nil {
+    return nil, fmt.Errorf("Could not parse isolated subnet: %s", err)
+  }
+
+  ones, bits := ipNet.Mask.Size()
+  if ipNet.IP.To4() == nil || bits != 32 || ones > 24 {
+    return nil, fmt.Errorf("Isolated subnet must be an IPv4 subnet of at least /24: %s", subnet)
+  }
+
+  return &isolatedBridges{
+    subnet:  ipNet,
+    slots:   make([]string, 1 << uint(24 - ones)),
+    bridges: make(map[string]*run.Bridge),
+  }, nil
+}
+
+// Get returns the private bridge of the task, creating it if necessary
+func (ib *isolatedBridges) Get(task *Task, cacheDir string, dryRun bool) (*run.Bridge, error) {
+  ib.Lock()
+  defer ib.Unlock()
+
+  if b, ok := ib.bridges[task.UUID()]; ok {
+    return b, nil
+  }
+
+  // Find a free /24 for this task
+  slot := -1
+  for i, uuid := range ib.slots {
+    if uuid == "" {
+      slot = i
+      break
+    }
+  }
+  if slot < 0 {
+    return nil, fmt.Errorf("No free subnets left for isolated networks")
+  }
+
+  ip := make(net.IP, 4)
+  binary.BigEndian.PutUint32(
+    ip, binary.BigEndian.Uint32(ib.subnet.IP.To4()) + uint32(slot) << 8 + 1,
+  )
+
+  // Interface names are limited to 15 characters, so the bridge is named after
+  // as much of the UUID as fits and must not clash with another interface
+  name := fmt.Sprintf("wf%s", task.UUID()[:13])
+  for uuid, other := range ib.bridges {
+    if other.Name == name {
+      return nil, fmt.Errorf(
+        "Isolated network %s of task %s is already used by task %s", name, task.UUID(), uuid,
+      )
+    }
+  }
+  if !dryRun {
+    if _, err := netlink.LinkByName(name); err == nil {
+      return nil, fmt.Errorf("Isolated network %s of task %s already exists", name, task.UUID())
+    }
+  }
+
+  // Each run of the task has a static IP after the bridge's, so that
+  // concurrent runs can reach each other by name
+  if len(task.runNames) > 253 {
+    return nil, fmt.Errorf("Too many runs for an isolated network: %d", len(task.runNames))
+  }
+
+  hosts := make(map[string]string)
+  for i, runName := range task.runNames {
+    host := make(net.IP, 4)
+    binary.BigEndian.PutUint32(host, binary.BigEndian.Uint32(ip) + uint32(i) + 1)
+    hosts[runName] = host.String()
+  }
+
+  b := &run.Bridge{
+    Name:     name,
+    Subnet:   fmt.Sprintf("%s/24", ip),
+    CacheDir: path.Join(cacheDir, "net", name),
+    Isolated: true,
+    Hosts:    hosts,
+  }
+
+  log.Debugf("Creating isolated network %s for task %s", b.Subnet, task.UUID())
+  err := b.Init(dryRun)
+  if err != nil {
+    b.Destroy(dryRun)
+    return nil, err
+  }
+
+  ib.slots[slot] = task.UUID()
+  ib.bridges[task.UUID()] = b
+
+  return b, nil
+}
+
+// Release tears down the private bridge of the task, if it has one
+func (ib *isolatedBridges) Release(task *Task, dryRun bool) {
+  ib.Lock()
+  defer ib.Unlock()
+
+  b, ok := ib.bridges[task.UUID()]
+  if !ok {
+    return
+  }
+
+  err := b.Destroy(dryRun)
+  if err != nil {
+    log.Warnf("Could not destroy isolated network: %s", err)
+  }
+
+  if !dryRun {
+    os.RemoveAll(b.CacheDir)
+  }
+
+  delete(ib.bridges, task.UUID())
+  for i, uuid := range ib.slots {
+    if uuid == task.UUID() {
+      ib.slots[i] = ""
+    }
+  }
+}
+
+// ReleaseAll tears down all private bridges
+func (ib *isolatedBridges) ReleaseAll(dryRun bool) {
+  ib.Lock()
+  var tasks []*Task
+  for uuid := range ib.bridges {
+    tasks = append(tasks, &Task{uuid: uuid})
+  }
+  ib.Unlock()
+
+  for _, task := range tasks {
+    ib.Release(task, dryRun)
+  }
+}
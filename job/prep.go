@@ -33,24 +33,125 @@ package job
 import (
   "os"
   "fmt"
+  "path"
+  "sync"
   "strings"
   "io/ioutil"
+  "encoding/json"
 
   "github.com/lancs-net/wayfinder/log"
 )
 
 type ProcValue struct {
-  Path     string
-  Original string
-  Current  string
+  Path     string `json:"path"`
+  Original string `json:"original"`
+  Current  string `json:"current"`
 }
 
 type Proc struct {
-  Items []ProcValue
+  sync.Mutex
+  Items   []ProcValue
+  journal   string // file where original values are persisted before writes
 }
 
 var procfs Proc
 
+// HostJournal returns the path of the journal of host changes in the workdir
+func HostJournal(workDir string) string {
+  return path.Join(workDir, ".cache", "host.journal")
+}
+
+// OpenJournal sets the journal file where the original values of the host are
+// persisted.  Entries of an existing journal, left behind by a job which did
+// not exit cleanly, are loaded so that the real original values are kept.
+func OpenJournal(journal string) error {
+  items, err := readJournal(journal)
+  if err != nil && !os.IsNotExist(err) {
+    return err
+  }
+
+  procfs.Lock()
+  defer procfs.Unlock()
+
+  if len(items) > 0 {
+    log.Warnf("Found %d unreverted host changes in %s", len(items), journal)
+    for _, item := range items {
+      procfs.remember(item.Path, item.Original, item.Current)
+    }
+  }
+
+  procfs.journal = journal
+
+  return nil
+}
+
+// readJournal loads the entries of a journal file
+func readJournal(journal string) ([]ProcValue, error) {
+  var items []ProcValue
+
+  dat, err := ioutil.ReadFile(journal)
+  if err != nil {
+    return nil, err
+  }
+
+  err = json.Unmarshal(dat, &items)
+  if err != nil {
+    return nil, fmt.Errorf("Could not parse journal %s: %s", journal, err)
+  }
+
+  return items, nil
+}
+
+// persist atomically writes the remembered items to the journal
+func (p *Proc) persist() error {
+  if len(p.journal) == 0 {
+    return nil
+  }
+
+  b, err := json.MarshalIndent(p.Items, "", "\t")
+  if err != nil {
+    return err
+  }
+
+  if err := os.MkdirAll(path.Dir(p.journal), os.ModePerm); err != nil {
+    return err
+  }
+
+  tmp := p.journal + ".tmp"
+  f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+  if err != nil {
+    return err
+  }
+
+  if _, err := f.Write(b); err != nil {
+    f.Close()
+    return err
+  }
+
+  // Make sure the journal survives a crash before the host is modified
+  if err := f.Sync(); err != nil {
+    f.Close()
+    return err
+  }
+
+  if err := f.Close(); err != nil {
+    return err
+  }
+
+  return os.Rename(tmp, p.journal)
+}
+
+// snapshot returns a copy of the remembered items, which can be read while
+// other goroutines change the host
+func (p *Proc) snapshot() []ProcValue {
+  p.Lock()
+  defer p.Unlock()
+
+  items := make([]ProcValue, len(p.Items))
+  copy(items, p.Items)
+  return items
+}
+
 // remember adds new item to our stateful procfs so we can revert later
 func (p *Proc) remember(path string, original string, new string) {
   for i, item := range p.Items {
@@ -65,6 +166,7 @@ func (p *Proc) remember(path string, original string, new string) {
 
       // Delete existing entry
       p.Items = append(p.Items[:i], p.Items[i+1:]...)
+      break
     }
   }
 
@@ -75,6 +177,27 @@ func (p *Proc) remember(path string, original string, new string) {
   })
 }
 
+// readProcfsValue returns the current value at a procfs or sysfs path.  For
+// entries which list all options with the selected one in brackets, such as
+// `always [madvise] never`, only the selected option is returned.
+func readProcfsValue(path string) (string, error) {
+  dat, err := ioutil.ReadFile(path)
+  if err != nil {
+    return "", fmt.Errorf("Could not read file: %s", err)
+  }
+
+  // Remove trailing \n if it exists
+  value := strings.TrimSuffix(string(dat), "\n")
+
+  start := strings.Index(value, "[")
+  end := strings.Index(value, "]")
+  if start >= 0 && end > start {
+    value = value[start+1:end]
+  }
+
+  return value, nil
+}
+
 // setProcfsValue sets a string value at a procfs path
 func setProcfsValue(path string, value string, dryRun bool) error {
   // Check if the path is set
@@ -86,26 +209,26 @@ func setProcfsValue(path string, value string, dryRun bool) error {
   stat, err := os.Stat(path); 
   if os.IsNotExist(err) {
     return fmt.Errorf("File does not exist: %s", path)
+  } else if err != nil {
+    return err
   }
 
-  // Check if this file receives input via stdin
-  if stat.Size() == 0 {
+  // Check if this file only receives input, e.g. vm/drop_caches.  Note that
+  // procfs files always report a size of zero so the mode is used instead.
+  if stat.Mode().Perm() & 0444 == 0 {
     log.Infof("Setting %s to %s", path, value)
 
   // This is a regular proc file with a set value
   } else {
-    dat, err := ioutil.ReadFile(path)
+    current, err := readProcfsValue(path)
     if err != nil {
       if dryRun {
-        log.Warnf("Could not read file: %s", err)
+        log.Warn(err)
       } else {
-        return fmt.Errorf("Could not read file: %s", err)
+        return err
       }
     }
 
-    // Remove trailing \n if it exists
-    current := strings.TrimSuffix(string(dat), "\n")
-
     // No need to set identical value
     if current == value {
       return nil
@@ -113,8 +236,17 @@ func setProcfsValue(path string, value string, dryRun bool) error {
 
     log.Infof("Setting %s from %s to %s", path, current, value)
 
-    // Save the current value for later reset
+    // Save the current value for later reset, persisting it before the host
+    // is changed.
+    procfs.Lock()
     procfs.remember(path, current, value)
+    if !dryRun {
+      err = procfs.persist()
+    }
+    procfs.Unlock()
+    if err != nil {
+      return fmt.Errorf("Could not write journal: %s", err)
+    }
   }
   
   // Open file
@@ -143,115 +275,79 @@ func setProcfsValue(path string, value string, dryRun bool) error {
   return nil
 }
 
-func PrepareEnvironment(cpus []int, dryRun bool) error {
+// PrepareEnvironment sets the host up according to the profile
+func PrepareEnvironment(profile *HostProfile, cpus []int, dryRun bool) error {
   if _, err := os.Stat("/proc/self/ns/user"); os.IsNotExist(err) {
-		return fmt.Errorf("userns is unsupported")
-	}
-
-  /*
-   * Filesystem preparation
-   */
-
-  err := setProcfsValue("/proc/sys/fs/file-max", "20000", dryRun)
-  if err != nil {
-    return err
+    return fmt.Errorf("userns is unsupported")
   }
 
-  // Drop fs cache
-  // err = setProcfsValue("/proc/sys/vm/drop_caches", "3", dryRun)
-  // if err != nil {
-  //   return err
-  // }
-
-  /*
-   * Networking preparation
-   */
-
-  err = setProcfsValue("/proc/sys/net/core/somaxconn", "1024", dryRun)
-  if err != nil {
-    return err
+  if profile == nil {
+    profile = &DefaultHostProfile
   }
 
-  err = setProcfsValue("/proc/sys/net/ipv4/ip_forward", "1", dryRun)
-  if err != nil {
-    return err
-  }
+  for _, setting := range profile.Settings(cpus) {
+    err := setProcfsValue(setting.Path, setting.Value, dryRun)
+    if err == nil {
+      continue
+    } else if setting.Required {
+      return err
+    }
 
-  err = setProcfsValue("/proc/sys/net/ipv4/ip_local_port_range", "1024   60999", dryRun)
-  if err != nil {
-    return err
+    log.Warnf("Cannot set %s: %s", setting.Path, err)
   }
 
-  // err = setProcfsValue("/proc/sys/net/ipv4/tcp_tw_reusee", "1", dryRun)
-  // if err != nil {
-  //   return err
-  // }
-
-  err = setProcfsValue("/proc/sys/net/ipv4/tcp_keepalive_time", "60", dryRun)
-  if err != nil {
-    return err
-  }
-  
-  err = setProcfsValue("/proc/sys/net/ipv4/tcp_keepalive_intvl", "60", dryRun)
-  if err != nil {
-    return err
-  }
+  return nil
+}
 
-  /*
-   * Processor preparation
-   */
-  // Set scaling governor performance
-  for _, c := range cpus {
-    err = setProcfsValue(fmt.Sprintf("/sys/devices/system/cpu/cpu%d/cpufreq/scaling_governor", c), "performance", dryRun)
+// RevertEnvironment sets original Procfs entries and removes the journal once
+// all entries have been reverted
+func RevertEnvironment(dryRun bool) error {
+  // Reset updated procfs items
+  failed := 0
+  for _, item := range procfs.snapshot() {
+    err := setProcfsValue(item.Path, item.Original, dryRun)
     if err != nil {
-      log.Warnf("Cannot set scaling governor: %s", err)
+      log.Warn(err)
+      failed++
     }
+  }
 
-    // err = setProcfsValue(fmt.Sprintf("/sys/devices/system/cpu/cpu%d/online", c), "0", dryRun)
-    // if err != nil {
-    //   log.Warnf("Cannot set scaling governor: %s", err)
-    // }
+  if failed > 0 {
+    return fmt.Errorf("Could not revert %d host changes", failed)
+  } else if dryRun {
+    return nil
   }
-  
-  // Disable Intel Turbo mode
-  // TODO: Determine if this setting is even possible on this machine
-  err = setProcfsValue("/sys/devices/system/cpu/intel_pstate/no_turbo", "1", dryRun)
-  if err != nil {
-    log.Warnf("Cannot set Intel Turbo mode: %s", err)
+
+  procfs.Lock()
+  defer procfs.Unlock()
+
+  procfs.Items = nil
+  if len(procfs.journal) > 0 {
+    err := os.Remove(procfs.journal)
+    if err != nil && !os.IsNotExist(err) {
+      return err
+    }
   }
 
-  /*
-   * Memory prepraration
-   */
+  return nil
+}
 
-  // Disable ASLR
-  err = setProcfsValue("/proc/sys/kernel/randomize_va_space", "0", dryRun)
-  if err != nil {
+// RestoreEnvironment reverts the host changes recorded in a journal
+func RestoreEnvironment(journal string, dryRun bool) error {
+  items, err := readJournal(journal)
+  if os.IsNotExist(err) {
+    log.Infof("No host changes to revert")
+    return nil
+  } else if err != nil {
     return err
   }
 
-  /*
-   * Namespacing
-   */
-
-  // Allow rootless containers
-  err = setProcfsValue("/proc/sys/kernel/unprivileged_userns_clone", "1", dryRun)
+  err = OpenJournal(journal)
   if err != nil {
     return err
   }
 
-  return nil
-}
-
-// RevertEnvironment sets original Procfs entries 
-func RevertEnvironment(dryRun bool) error {
-  // Reset updated procfs itemss
-  for _, item := range procfs.Items {
-    err := setProcfsValue(item.Path, item.Original, dryRun)
-    if err != nil {
-      log.Warn(err)
-    }
-  }
+  log.Infof("Reverting %d host changes from %s...", len(items), journal)
 
-  return nil
+  return RevertEnvironment(dryRun)
 }
@@ -0,0 +1,212 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "os"
+  "fmt"
+  "time"
+  "bufio"
+  "strings"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/json"
+
+  "golang.org/x/sys/unix"
+)
+
+// Provenance describes the machine and software which produced the results of
+// a job so that they can be reproduced.
+type Provenance struct {
+  Wayfinder Software          `json:"wayfinder"`
+  Job       JobFile           `json:"job"`
+  Host      HostInfo          `json:"host"`
+  Images    map[string]string `json:"images"` // digest of each image
+  StartTime string            `json:"start_time"`
+}
+
+// Software identifies the version of wayfinder
+type Software struct {
+  Version   string `json:"version"`
+  Commit    string `json:"commit"`
+  BuildTime string `json:"build_time"`
+}
+
+// JobFile identifies the job file, and the files it includes, by their
+// contents
+type JobFile struct {
+  Path       string   `json:"path"`
+  SHA256     string   `json:"sha256"`
+  Includes []JobFile  `json:"includes,omitempty"`
+}
+
+// HostInfo is the fingerprint of the host
+type HostInfo struct {
+  Hostname      string     `json:"hostname"`
+  KernelRelease string     `json:"kernel_release"`
+  KernelVersion string     `json:"kernel_version"`
+  Architecture  string     `json:"architecture"`
+  CpuModel      string     `json:"cpu_model"`
+  Microcode     string     `json:"microcode"`
+  Cpus        []CpuInfo    `json:"cpus"`
+  SMT           string     `json:"smt"`
+  Turbo         string     `json:"turbo"`
+  Memory        string     `json:"memory"`
+  NUMA        []NUMANode   `json:"numa"`
+}
+
+// CpuInfo is the frequency scaling state of a CPU used by the job
+type CpuInfo struct {
+  ID       int    `json:"id"`
+  Driver   string `json:"driver"`
+  Governor string `json:"governor"`
+}
+
+// NUMANode is the layout of a NUMA node
+type NUMANode struct {
+  Name   string `json:"name"`
+  Cpus   string `json:"cpus"`
+  Memory string `json:"memory"`
+}
+
+// readSysValue returns the trimmed contents of a file, or an empty string if
+// it is not available on this host
+func readSysValue(path string) string {
+  dat, err := ioutil.ReadFile(path)
+  if err != nil {
+    return ""
+  }
+
+  return strings.TrimSpace(string(dat))
+}
+
+// readKeyValue returns the value of the first line starting with key in a file
+// with `key: value` lines, such as /proc/cpuinfo and /proc/meminfo
+func readKeyValue(path, key string) string {
+  f, err := os.Open(path)
+  if err != nil {
+    return ""
+  }
+
+  defer f.Close()
+
+  scanner := bufio.NewScanner(f)
+  for scanner.Scan() {
+    line := scanner.Text()
+    i := strings.Index(line, ":")
+    if i < 0 {
+      continue
+    }
+
+    if strings.TrimSpace(line[:i]) == key {
+      return strings.TrimSpace(line[i+1:])
+    }
+  }
+
+  return ""
+}
+
+// utsString converts a field of utsname to a string
+func utsString(b []byte) string {
+  return strings.TrimRight(string(b), "\x00")
+}
+
+// fingerprintHost captures the state of the host for the given CPUs
+func fingerprintHost(cpus []int) HostInfo {
+  info := HostInfo{
+    CpuModel:  readKeyValue("/proc/cpuinfo", "model name"),
+    Microcode: readKeyValue("/proc/cpuinfo", "microcode"),
+    SMT:       readSysValue("/sys/devices/system/cpu/smt/control"),
+    Memory:    readKeyValue("/proc/meminfo", "MemTotal"),
+  }
+
+  info.Hostname, _ = os.Hostname()
+
+  var uts unix.Utsname
+  if err := unix.Uname(&uts); err == nil {
+    info.KernelRelease = utsString(uts.Release[:])
+    info.KernelVersion = utsString(uts.Version[:])
+    info.Architecture = utsString(uts.Machine[:])
+  }
+
+  // Turbo is reported by intel_pstate as disabled or by cpufreq as enabled
+  if noTurbo := readSysValue("/sys/devices/system/cpu/intel_pstate/no_turbo"); noTurbo == "1" {
+    info.Turbo = "disabled"
+  } else if noTurbo == "0" {
+    info.Turbo = "enabled"
+  } else if boost := readSysValue("/sys/devices/system/cpu/cpufreq/boost"); boost == "1" {
+    info.Turbo = "enabled"
+  } else if boost == "0" {
+    info.Turbo = "disabled"
+  }
+
+  for _, cpu := range cpus {
+    cpufreq := fmt.Sprintf("/sys/devices/system/cpu/cpu%d/cpufreq", cpu)
+    info.Cpus = append(info.Cpus, CpuInfo{
+      ID:       cpu,
+      Driver:   readSysValue(filepath.Join(cpufreq, "scaling_driver")),
+      Governor: readSysValue(filepath.Join(cpufreq, "scaling_governor")),
+    })
+  }
+
+  nodes, _ := filepath.Glob("/sys/devices/system/node/node[0-9]*")
+  for _, node := range nodes {
+    name := filepath.Base(node)
+    info.NUMA = append(info.NUMA, NUMANode{
+      Name:   name,
+      Cpus:   readSysValue(filepath.Join(node, "cpulist")),
+      Memory: readKeyValue(
+        filepath.Join(node, "meminfo"),
+        fmt.Sprintf("Node %s MemTotal", strings.TrimPrefix(name, "node")),
+      ),
+    })
+  }
+
+  return info
+}
+
+// writeProvenance writes the provenance manifest of the job
+func (j *Job) writeProvenance(images map[string]string) error {
+  p := Provenance{
+    Wayfinder: j.software,
+    Job:       j.file,
+    Host:      fingerprintHost(j.cpus),
+    Images:    images,
+    StartTime: time.Now().Format(time.RFC3339),
+  }
+
+  b, err := json.MarshalIndent(p, "", "\t")
+  if err != nil {
+    return fmt.Errorf("Could not marshal JSON of provenance: %s", err)
+  }
+
+  return ioutil.WriteFile(filepath.Join(j.workDir, "results", "provenance.json"), b, 0644)
+}
@@ -0,0 +1,394 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+  "reflect"
+  "encoding/json"
+
+  "gopkg.in/yaml.v3"
+)
+
+// jsonSchema is the subset of JSON Schema (draft-07) used to describe and
+// validate job files
+type jsonSchema struct {
+  Schema               string                 `json:"$schema,omitempty"`
+  Ref                  string                 `json:"$ref,omitempty"`
+  Title                string                 `json:"title,omitempty"`
+  Type                 interface{}            `json:"type,omitempty"`
+  Enum               []string                 `json:"enum,omitempty"`
+  Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+  Required           []string                 `json:"required,omitempty"`
+  AdditionalProperties interface{}            `json:"additionalProperties,omitempty"`
+  Items               *jsonSchema             `json:"items,omitempty"`
+  Definitions          map[string]*jsonSchema `json:"definitions,omitempty"`
+}
+
+// scalarTypes are accepted for string fields, since YAML scalars such as
+// `only: [1, 2]` are decoded into strings
+var scalarTypes = []string{"string", "number", "boolean"}
+
+// jobSchema is the schema of job files, generated from the Job struct
+var jobSchema = newJobSchema()
+
+func newJobSchema() *jsonSchema {
+  defs := make(map[string]*jsonSchema)
+  root := schemaOf(reflect.TypeOf(Job{}), defs)
+
+  // Templates are runs which only need a name, since the runs which extend
+  // them are checked once they are complete
+  template := *defs["Run"]
+  template.Required = []string{"name"}
+  defs["RunTemplate"] = &template
+  defs["Job"].Properties["templates"] = &jsonSchema{
+    Type:  "array",
+    Items: &jsonSchema{Ref: "#/definitions/RunTemplate"},
+  }
+
+  return &jsonSchema{
+    Schema:      "http://json-schema.org/draft-07/schema#",
+    Ref:         root.Ref,
+    Title:       "wayfinder job",
+    Definitions: defs,
+  }
+}
+
+// Schema returns the JSON Schema of job files
+func Schema() ([]byte, error) {
+  return json.MarshalIndent(jobSchema, "", "  ")
+}
+
+// schemaOf returns the schema of a type.  Structs are added to the definitions
+// and referenced so that recursive types, such as nested parameters, are
+// supported.
+func schemaOf(t reflect.Type, defs map[string]*jsonSchema) *jsonSchema {
+  switch t.Kind() {
+  case reflect.Ptr:
+    return schemaOf(t.Elem(), defs)
+  case reflect.String:
+    return &jsonSchema{Type: scalarTypes}
+  case reflect.Bool:
+    return &jsonSchema{Type: "boolean"}
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+       reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+    return &jsonSchema{Type: "integer"}
+  case reflect.Float32, reflect.Float64:
+    return &jsonSchema{Type: "number"}
+  case reflect.Slice, reflect.Array:
+    return &jsonSchema{Type: "array", Items: schemaOf(t.Elem(), defs)}
+  case reflect.Map:
+    return &jsonSchema{
+      Type:                 "object",
+      AdditionalProperties: schemaOf(t.Elem(), defs),
+    }
+  case reflect.Struct:
+    name := t.Name()
+    if _, ok := defs[name]; !ok {
+      s := &jsonSchema{
+        Type:                 "object",
+        Properties:           make(map[string]*jsonSchema),
+        AdditionalProperties: false,
+      }
+      defs[name] = s
+      addProperties(s, t, defs)
+    }
+    return &jsonSchema{Ref: "#/definitions/" + name}
+  }
+
+  return &jsonSchema{}
+}
+
+// addProperties adds the fields of a struct, as seen by yaml, to the schema
+func addProperties(s *jsonSchema, t reflect.Type, defs map[string]*jsonSchema) {
+  for i := 0; i < t.NumField(); i++ {
+    field := t.Field(i)
+    if len(field.PkgPath) > 0 {
+      continue // unexported
+    }
+
+    tag := strings.Split(field.Tag.Get("yaml"), ",")
+    name := tag[0]
+    if name == "-" {
+      continue
+    }
+
+    // Fields of inlined structs are properties of the parent
+    inline := false
+    for _, opt := range tag[1:] {
+      inline = inline || opt == "inline"
+    }
+    if inline {
+      ft := field.Type
+      if ft.Kind() == reflect.Ptr {
+        ft = ft.Elem()
+      }
+      addProperties(s, ft, defs)
+      continue
+    }
+
+    if len(name) == 0 {
+      name = strings.ToLower(field.Name)
+    }
+
+    prop := schemaOf(field.Type, defs)
+    for _, opt := range strings.Split(field.Tag.Get("schema"), ",") {
+      if opt == "required" {
+        s.Required = append(s.Required, name)
+      } else if strings.HasPrefix(opt, "enum=") {
+        prop.Enum = strings.Split(strings.TrimPrefix(opt, "enum="), "|")
+      }
+    }
+
+    s.Properties[name] = prop
+  }
+}
+
+// schemaError is a violation of the schema at a node of the job file
+type schemaError struct {
+  node *yaml.Node
+  path []interface{}
+  msg  string
+}
+
+// resolve follows a reference to its definition
+func (s *jsonSchema) resolve() *jsonSchema {
+  for len(s.Ref) > 0 {
+    s = jobSchema.Definitions[strings.TrimPrefix(s.Ref, "#/definitions/")]
+  }
+  return s
+}
+
+// yamlBools are the plain scalars which yaml.v2, which decodes job files,
+// reads as booleans even though YAML 1.2 reads them as strings
+var yamlBools = map[string]bool{
+  "y": true, "Y": true, "yes": true, "Yes": true, "YES": true,
+  "n": true, "N": true, "no": true, "No": true, "NO": true,
+  "on": true, "On": true, "ON": true, "off": true, "Off": true, "OFF": true,
+}
+
+// typeOf returns the JSON Schema type of a node
+func typeOf(n *yaml.Node) string {
+  switch n.Kind {
+  case yaml.SequenceNode:
+    return "array"
+  case yaml.MappingNode:
+    return "object"
+  case yaml.ScalarNode:
+    switch n.ShortTag() {
+    case "!!str":
+      if n.Style == 0 && yamlBools[n.Value] {
+        return "boolean"
+      }
+      return "string"
+    case "!!bool":
+      return "boolean"
+    case "!!int":
+      return "integer"
+    case "!!float":
+      return "number"
+    case "!!null":
+      return "null"
+    }
+    return "string"
+  }
+  return "null"
+}
+
+// hasType checks whether a value of type t is allowed by the schema's types
+func (s *jsonSchema) hasType(t string) bool {
+  var types []string
+  switch st := s.Type.(type) {
+  case string:
+    types = []string{st}
+  case []string:
+    types = st
+  default:
+    return true
+  }
+
+  for _, allowed := range types {
+    if allowed == t || (allowed == "number" && t == "integer") {
+      return true
+    }
+  }
+  return false
+}
+
+// validate checks the node against the schema and records all violations
+func (s *jsonSchema) validate(n *yaml.Node, path []interface{}, errs *[]schemaError) {
+  s = s.resolve()
+
+  for n != nil && n.Kind == yaml.AliasNode {
+    n = n.Alias
+  }
+  if n != nil && n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+    n = n.Content[0]
+  }
+
+  // Unset values are left at their defaults
+  if n == nil || typeOf(n) == "null" {
+    return
+  }
+
+  fail := func(format string, a ...interface{}) {
+    *errs = append(*errs, schemaError{n, path, fmt.Sprintf(format, a...)})
+  }
+
+  t := typeOf(n)
+  if !s.hasType(t) {
+    fail("expected %s, got %s", typeName(s.Type), t)
+    return
+  }
+
+  if len(s.Enum) > 0 {
+    found := false
+    for _, e := range s.Enum {
+      found = found || e == n.Value
+    }
+    if !found {
+      fail("invalid value %q, expected one of: %s", n.Value, strings.Join(s.Enum, ", "))
+    }
+  }
+
+  switch n.Kind {
+  case yaml.SequenceNode:
+    if s.Items != nil {
+      for i, item := range n.Content {
+        s.Items.validate(item, appendPath(path, i), errs)
+      }
+    }
+
+  case yaml.MappingNode:
+    keys := make(map[string]bool)
+    for i := 0; i+1 < len(n.Content); i += 2 {
+      keys[n.Content[i].Value] = true
+    }
+
+    for _, req := range s.Required {
+      if !keys[req] {
+        fail("missing required field %q", req)
+      }
+    }
+
+    for i := 0; i+1 < len(n.Content); i += 2 {
+      key, item := n.Content[i], n.Content[i+1]
+      if prop, ok := s.Properties[key.Value]; ok {
+        prop.validate(item, appendPath(path, key.Value), errs)
+      } else if additional, ok := s.AdditionalProperties.(*jsonSchema); ok {
+        additional.validate(item, appendPath(path, key.Value), errs)
+      } else if s.AdditionalProperties == false {
+        *errs = append(*errs, schemaError{
+          key,
+          appendPath(path, key.Value),
+          fmt.Sprintf("unknown field %q", key.Value),
+        })
+      }
+    }
+  }
+}
+
+// typeName returns a readable name of the schema's types
+func typeName(t interface{}) string {
+  if types, ok := t.([]string); ok {
+    return strings.Join(types, " or ")
+  }
+  return fmt.Sprint(t)
+}
+
+// appendPath returns a copy of the path with the key or index appended
+func appendPath(path []interface{}, elem interface{}) []interface{} {
+  p := make([]interface{}, len(path), len(path)+1)
+  copy(p, path)
+  return append(p, elem)
+}
+
+// formatPath returns the path in dotted notation, e.g. `runs[0].netem`
+func formatPath(path []interface{}) string {
+  var b strings.Builder
+  for _, elem := range path {
+    switch e := elem.(type) {
+    case int:
+      fmt.Fprintf(&b, "[%d]", e)
+    default:
+      if b.Len() > 0 {
+        b.WriteString(".")
+      }
+      fmt.Fprint(&b, e)
+    }
+  }
+  return b.String()
+}
+
+// validateNode checks a decoded job against the schema and returns all
+// violations, located by the line and column of their node within the file
+// the node was read from
+func validateNode(doc *yaml.Node, fileOf func(*yaml.Node) string) error {
+  var errs []schemaError
+  jobSchema.validate(doc, nil, &errs)
+  if len(errs) == 0 {
+    return nil
+  }
+
+  type located struct {
+    file      string
+    line, col int
+    msg       string
+  }
+
+  var found []located
+  for _, e := range errs {
+    msg := e.msg
+    if len(e.path) > 0 {
+      msg = fmt.Sprintf("%s: %s", formatPath(e.path), e.msg)
+    }
+    found = append(found, located{fileOf(e.node), e.node.Line, e.node.Column, msg})
+  }
+
+  // Report violations in the order they appear in the files
+  sort.SliceStable(found, func(i, j int) bool {
+    if found[i].file != found[j].file {
+      return found[i].file < found[j].file
+    } else if found[i].line != found[j].line {
+      return found[i].line < found[j].line
+    }
+    return found[i].col < found[j].col
+  })
+
+  var msgs []string
+  for _, f := range found {
+    msgs = append(msgs, fmt.Sprintf("%s:%d:%d: %s", f.file, f.line, f.col, f.msg))
+  }
+
+  return fmt.Errorf("Does not match schema:\n  %s", strings.Join(msgs, "\n  "))
+}
@@ -0,0 +1,123 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "os"
+  "strings"
+  "testing"
+  "path/filepath"
+)
+
+func TestSchema(t *testing.T) {
+  tests := []struct {
+    name string
+    job  string
+    errs []string
+  }{{
+    name: "valid job",
+    job: `params:
+  - name: A
+    type: int
+    only: [1, 2]
+runs:
+  - name: run
+    image: alpine
+    network: isolated
+    netem:
+      delay: 10ms
+`,
+  }, {
+    name: "misplaced key",
+    job: `params:
+  - name: A
+    type: int
+    only: [1, 2]
+    netem:
+      delay: 10ms
+runs:
+  - name: run
+    image: alpine
+    network: isolated
+`,
+    errs: []string{
+      `job.yaml:5:5: params[0].netem: unknown field "netem"`,
+    },
+  }, {
+    name: "key of a run at the top level",
+    job: `runs:
+  - name: run
+    image: alpine
+network: isolated
+`,
+    errs: []string{
+      `job.yaml:4:1: network: unknown field "network"`,
+    },
+  }, {
+    name: "all mistakes in the order of the file",
+    job: `params:
+  - name: A
+    typ: int
+runs:
+  - name: run
+    network: bridge
+    cores: many
+`,
+    errs: []string{
+      `job.yaml:3:5: params[0].typ: unknown field "typ"`,
+      `job.yaml:5:5: runs[0]: missing required field "image"`,
+      `job.yaml:6:14: runs[0].network: invalid value "bridge", expected one of: none, isolated, bridged, host`,
+      `job.yaml:7:12: runs[0].cores: expected integer, got string`,
+    },
+  }}
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      dir := writeTree(t, map[string]string{"job.yaml": test.job})
+      defer os.RemoveAll(dir)
+
+      _, _, err := ParseJob(filepath.Join(dir, "job.yaml"))
+      if len(test.errs) == 0 {
+        if err != nil {
+          t.Fatal(err)
+        }
+        return
+      }
+
+      expected := "Does not match schema:\n  " + strings.Join(test.errs, "\n  ")
+      if err == nil {
+        t.Fatalf("expected error %q", expected)
+      } else if e := strings.ReplaceAll(err.Error(), dir+"/", ""); e != expected {
+        t.Errorf("expected error:\n%s\ngot:\n%s", expected, e)
+      }
+    })
+  }
+}
@@ -36,6 +36,7 @@ import (
   "fmt"
   "time"
   "path"
+  "sort"
   "strings"
 	"crypto/md5"
 
@@ -47,14 +48,18 @@ type TaskParam struct {
   Name  string
   Type  string
   Value string
+  Host  string // path of the host knob the value is applied to
 }
 
 // Task is the specific iterated configuration
 type Task struct {
   Params      []TaskParam
+  Derived     []TaskParam // computed from Params, not part of the UUID
   Inputs     *[]run.Input
   Outputs    *[]run.Output
   runs         *Queue
+  active        int32 // number of runs in flight
+  runNames    []string
   uuid          string
   resultsDir    string
   cacheDir      string
@@ -95,8 +100,10 @@ func (t *Task) Init(workDir string, allowOverride bool, runs *[]run.Run, dryRun
   }
 
   // Add the runs in-order
+  t.runNames = nil
   for _, run := range *runs {
     t.runs.Enqueue(run)
+    t.runNames = append(t.runNames, run.Name)
   }
 
   return nil
@@ -110,6 +117,50 @@ func (t *Task) Cancel() {
   t.runs.Clear()
 }
 
+// paramValue returns the value of the parameter with the given name
+func paramValue(params []TaskParam, name string) (string, bool) {
+  for _, param := range params {
+    if param.Name == name {
+      return param.Value, true
+    }
+  }
+
+  return "", false
+}
+
+// params returns the task's parameters followed by its derived parameters
+func (t *Task) params() []TaskParam {
+  return append(append([]TaskParam{}, t.Params...), t.Derived...)
+}
+
+// runParams returns the task's parameters as passed to its runs
+func (t *Task) runParams() []run.Param {
+  var params []run.Param
+  for _, param := range t.params() {
+    params = append(params, run.Param{
+      Name:  param.Name,
+      Type:  param.Type,
+      Value: param.Value,
+    })
+  }
+  return params
+}
+
+// lookup returns the value of the task's parameter with the given name.
+// Unknown names are left as references.
+func (t *Task) lookup(name string) string {
+  if value, ok := paramValue(t.params(), name); ok {
+    return value
+  }
+
+  return fmt.Sprintf("${%s}", name)
+}
+
+// Expand replaces references to the task's parameters in the string
+func (t *Task) Expand(s string) string {
+  return os.Expand(s, t.lookup)
+}
+
 func (t *Task) UUID() string {
   if len(t.uuid) == 0 {
 
@@ -136,16 +187,18 @@ type ActiveTaskRun struct {
   dryRun      bool
   bridge     *run.Bridge
   maxRetries  int
+  quiet       bool // whether the output of the run is not echoed
 }
 
 // NewActiveTaskRun initializes the current task and the run step for the
 // the specified cores.
-func NewActiveTaskRun(task *Task, run run.Run, coreIds []int, bridge *run.Bridge, dryRun bool, maxRetries int) (*ActiveTaskRun, error) {
+func NewActiveTaskRun(task *Task, run run.Run, coreIds []int, bridge *run.Bridge, dryRun bool, maxRetries int, quiet bool) (*ActiveTaskRun, error) {
   atr := &ActiveTaskRun{
     Task:       task,
     run:       &run,
     CoreIds:    coreIds,
     maxRetries: maxRetries,
+    quiet:      quiet,
   }
 
   atr.log = &log.Logger{
@@ -168,7 +221,17 @@ func (atr *ActiveTaskRun) Start() (int, time.Duration, error) {
   var env []string
   var err error
 
-  for _, param := range atr.Task.Params {
+  // Variables of the run come first, so that parameters take precedence
+  var names []string
+  for name := range atr.run.Env {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  for _, name := range names {
+    env = append(env, fmt.Sprintf("%s=%s", name, atr.Task.Expand(atr.run.Env[name])))
+  }
+
+  for _, param := range atr.Task.params() {
     env = append(env, fmt.Sprintf("%s=%s", param.Name, param.Value))
   }
 
@@ -191,15 +254,33 @@ func (atr *ActiveTaskRun) Start() (int, time.Duration, error) {
     Devices:       atr.run.Devices,
     Inputs:        atr.Task.Inputs,
     Outputs:       atr.Task.Outputs,
+    Runs:          atr.Task.runNames,
     Env:           env,
     Capabilities:  atr.run.Capabilities,
+    Network:       atr.run.Network,
+    Netem:         atr.run.Netem.Expand(atr.Task.lookup),
+    Resources:     atr.run.Resources.Expand(atr.Task.lookup),
+    Params:        atr.Task.runParams(),
+    ParamFile:     atr.run.ParamFile,
+    Workdir:       atr.Task.Expand(atr.run.Workdir),
+    User:          atr.Task.Expand(atr.run.User),
+    Quiet:         atr.quiet,
   }
-  if atr.run.Path != "" {
+  if len(atr.run.Entrypoint) > 0 {
+    for _, arg := range atr.run.Entrypoint {
+      config.Entrypoint = append(config.Entrypoint, atr.Task.Expand(arg))
+    }
+  } else if atr.run.Path != "" {
     config.Path = atr.run.Path
   } else if atr.run.Cmd != "" {
     config.Cmd = atr.run.Cmd
+    config.Shell = atr.run.Shell
   } else {
-    return 1, -1, fmt.Errorf("Run did not specify path or cmd: %s", atr.run.Name)
+    return 1, -1, fmt.Errorf("Run did not specify path, cmd or entrypoint: %s", atr.run.Name)
+  }
+
+  for _, arg := range atr.run.Args {
+    config.Args = append(config.Args, atr.Task.Expand(arg))
   }
 
   atr.Runner, err = run.NewRunner(config, atr.bridge, atr.dryRun)
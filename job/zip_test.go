@@ -0,0 +1,141 @@
+package job
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "reflect"
+  "strings"
+  "testing"
+)
+
+func TestZip(t *testing.T) {
+  tests := []struct {
+    name   string
+    params []JobParam
+    tasks  []string
+    err    string
+  }{{
+    name: "members in lockstep",
+    params: []JobParam{{Zip: []JobParam{
+      {Name: "A", Type: "int", Only: []string{"1", "2", "4"}},
+      {Name: "B", Type: "int", Min: "2", Max: "8", Step: "2", StepMode: "multiply"},
+    }}},
+    tasks: []string{"A=1 B=2", "A=2 B=4", "A=4 B=8"},
+  }, {
+    name: "with sub-parameters and siblings",
+    params: []JobParam{
+      {Zip: []JobParam{
+        {Name: "A", Type: "int", Only: []string{"1", "2"}},
+        {Name: "B", Type: "string", Only: []string{"x", "y"}},
+      }, Params: []JobParam{{Name: "C", Type: "int", Only: []string{"0"}, When: "A == 2"}}},
+      {Name: "D", Type: "bool"},
+    },
+    tasks: []string{
+      "A=1 B=x D=true", "A=1 B=x D=false",
+      "A=2 B=y C=0 D=true", "A=2 B=y C=0 D=false",
+    },
+  }, {
+    name: "members of generated values",
+    params: []JobParam{{Zip: []JobParam{
+      {Name: "A", Type: "int", Min: "1", Max: "3"},
+      {Name: "B", Type: "float", Min: "0", Max: "1", StepMode: "linspace", Count: "3"},
+      {Name: "C", Type: "size", Min: "1K", Max: "4K", StepMode: "multiply"},
+    }}},
+    tasks: []string{"A=1 B=0 C=1024", "A=2 B=0.5 C=2048", "A=3 B=1 C=4096"},
+  }, {
+    name: "bool and string members of different lengths",
+    params: []JobParam{{Zip: []JobParam{
+      {Name: "A", Type: "string", Only: []string{"x", "y", "z"}},
+      {Name: "B", Type: "bool"},
+    }}},
+    err: "same number of values: A has 3, B has 2",
+  }, {
+    name: "single member",
+    params: []JobParam{{Zip: []JobParam{{Name: "A", Type: "int", Only: []string{"1", "2"}}}}},
+    tasks: []string{"A=1", "A=2"},
+  }, {
+    name: "host knobs",
+    params: []JobParam{{Zip: []JobParam{
+      {Name: "A", Type: "int", Only: []string{"0", "60"}, Host: "vm.swappiness"},
+      {Name: "B", Type: "int", Only: []string{"1", "2"}},
+    }}},
+    tasks: []string{"A=0 B=1", "A=60 B=2"},
+  }, {
+    name: "members of different lengths",
+    params: []JobParam{{Zip: []JobParam{
+      {Name: "A", Type: "int", Only: []string{"1", "2"}},
+      {Name: "B", Type: "int", Only: []string{"1"}},
+    }}},
+    err: "same number of values: A has 2, B has 1",
+  }, {
+    name: "later member of a different length",
+    params: []JobParam{{Zip: []JobParam{
+      {Name: "A", Type: "int", Only: []string{"1", "2"}},
+      {Name: "B", Type: "int", Min: "1", Max: "2"},
+      {Name: "C", Type: "int", Min: "1", Max: "3"},
+    }}},
+    err: "same number of values: A has 2, C has 3",
+  }, {
+    name: "member without values",
+    params: []JobParam{{Zip: []JobParam{
+      {Name: "A", Type: "int", Only: []string{"1"}},
+      {Name: "B", Type: "string"},
+    }}},
+    err: "same number of values: A has 1, B has 0",
+  }, {
+    name: "group with a name",
+    params: []JobParam{{Name: "G", Zip: []JobParam{{Name: "A", Type: "int", Only: []string{"1"}}}}},
+    err: "cannot have a name",
+  }, {
+    name: "member with a condition",
+    params: []JobParam{{Zip: []JobParam{{Name: "A", Type: "int", Only: []string{"1"}, When: "y"}}}},
+    err: "cannot have params, when or zip",
+  }}
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      j := &Job{Params: test.params}
+      tasks, err := j.tasks()
+      if len(test.err) > 0 {
+        if err == nil || !strings.Contains(err.Error(), test.err) {
+          t.Fatalf("expected error %q, got %v", test.err, err)
+        }
+        return
+      } else if err != nil {
+        t.Fatal(err)
+      }
+
+      if got := taskStrings(tasks); !reflect.DeepEqual(got, test.tasks) {
+        t.Errorf("expected %q, got %q", test.tasks, got)
+      }
+    })
+  }
+}
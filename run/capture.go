@@ -0,0 +1,139 @@
+package run
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "path"
+  "sync"
+  "time"
+  "bytes"
+)
+
+// timestampFormat is the format of the time each captured line is prefixed
+// with
+const timestampFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// captureWriter appends each line written to it to a file, prefixed with the
+// time it was written at, and optionally echoes it to the console.  Partial
+// lines are held back until they are completed or the writer is closed.
+type captureWriter struct {
+  mu    sync.Mutex
+  file *os.File
+  echo  io.Writer
+  buf []byte
+}
+
+// newCaptureWriter opens the file in append mode, so that retries of a run
+// are kept alongside each other
+func newCaptureWriter(file string, echo io.Writer) (*captureWriter, error) {
+  f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+  if err != nil {
+    return nil, err
+  }
+
+  return &captureWriter{file: f, echo: echo}, nil
+}
+
+// Write implements io.Writer
+func (w *captureWriter) Write(b []byte) (int, error) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+
+  if w.echo != nil {
+    w.echo.Write(b)
+  }
+
+  w.buf = append(w.buf, b...)
+  for {
+    i := bytes.IndexByte(w.buf, '\n')
+    if i < 0 {
+      break
+    }
+
+    err := w.writeLine(w.buf[:i])
+    if err != nil {
+      return 0, err
+    }
+
+    w.buf = append([]byte{}, w.buf[i+1:]...)
+  }
+
+  return len(b), nil
+}
+
+// writeLine writes a single line with its timestamp to the file
+func (w *captureWriter) writeLine(line []byte) error {
+  _, err := fmt.Fprintf(w.file, "%s %s\n", time.Now().Format(timestampFormat), line)
+  return err
+}
+
+// Close writes the remaining partial line and closes the file
+func (w *captureWriter) Close() error {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+
+  if len(w.buf) > 0 {
+    w.writeLine(w.buf)
+    w.buf = nil
+  }
+
+  return w.file.Close()
+}
+
+// captureOutput returns the writers of the stdout and stderr of the run, which
+// are captured to `<run>.stdout` and `<run>.stderr` in the results directory of
+// the task and echoed to the console unless the run is quiet
+func (r *Runner) captureOutput() (*captureWriter, *captureWriter, error) {
+  var echo io.Writer
+  if !r.Config.Quiet {
+    echo = r.log
+  }
+
+  stdout, err := newCaptureWriter(
+    path.Join(r.Config.ResultsDir, r.Config.Name + ".stdout"), echo,
+  )
+  if err != nil {
+    return nil, nil, fmt.Errorf("Could not capture stdout: %s", err)
+  }
+
+  stderr, err := newCaptureWriter(
+    path.Join(r.Config.ResultsDir, r.Config.Name + ".stderr"), echo,
+  )
+  if err != nil {
+    stdout.Close()
+    return nil, nil, fmt.Errorf("Could not capture stderr: %s", err)
+  }
+
+  return stdout, stderr, nil
+}
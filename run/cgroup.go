@@ -0,0 +1,573 @@
+package run
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "os"
+  "fmt"
+  "path"
+  "bufio"
+  "strings"
+  "strconv"
+  "io/ioutil"
+
+  "golang.org/x/sys/unix"
+  "github.com/opencontainers/runc/libcontainer/configs"
+)
+
+const (
+  // CgroupV1 is the legacy hierarchy with one mount per controller
+  CgroupV1     = "v1"
+  // CgroupHybrid is the legacy hierarchy with an additional unified mount
+  // which has no controllers
+  CgroupHybrid = "hybrid"
+  // CgroupV2 is the unified hierarchy
+  CgroupV2     = "v2"
+
+  // CgroupParent is the cgroup under which the cgroups of all runs are placed
+  CgroupParent = "/wayfinder"
+
+  cgroupRoot   = "/sys/fs/cgroup"
+
+  // defaultCpuWeight is the weight of a run's cgroup on the unified hierarchy
+  defaultCpuWeight = 100
+)
+
+// Resources describes the limits of a run's cgroup.  Values are strings so
+// that they can reference task parameters, e.g. `memory: ${MEMORY}`.
+type Resources struct {
+  CpuWeight string    `yaml:"cpu_weight"`
+  Memory    string    `yaml:"memory"`
+  IO      []IOLimit   `yaml:"io"`
+}
+
+// IOLimit throttles the reads and writes of a run to a block device
+type IOLimit struct {
+  Device    string `yaml:"device" schema:"required"`
+  ReadBps   string `yaml:"rbps"`
+  WriteBps  string `yaml:"wbps"`
+  ReadIops  string `yaml:"riops"`
+  WriteIops string `yaml:"wiops"`
+}
+
+// sizeUnits are the binary units of memory sizes and byte rates
+var sizeUnits = map[string]int64{
+  "":  1,
+  "b": 1,
+  "k": 1 << 10,
+  "m": 1 << 20,
+  "g": 1 << 30,
+  "t": 1 << 40,
+}
+
+// Expand returns a copy of the resources with all references to variables
+// replaced by the mapping function.
+func (r *Resources) Expand(mapping func(string) string) *Resources {
+  if r == nil {
+    return nil
+  }
+
+  expand := func(s string) string {
+    return strings.TrimSpace(os.Expand(s, mapping))
+  }
+
+  res := &Resources{
+    CpuWeight: expand(r.CpuWeight),
+    Memory:    expand(r.Memory),
+  }
+
+  for _, limit := range r.IO {
+    res.IO = append(res.IO, IOLimit{
+      Device:    expand(limit.Device),
+      ReadBps:   expand(limit.ReadBps),
+      WriteBps:  expand(limit.WriteBps),
+      ReadIops:  expand(limit.ReadIops),
+      WriteIops: expand(limit.WriteIops),
+    })
+  }
+
+  return res
+}
+
+// ParseSize parses a size in bytes with an optional binary unit, e.g. `512M`.
+// Sizes may be zero, e.g. to sweep a buffer from none, but not negative.
+func ParseSize(value string) (int64, error) {
+  if len(value) == 0 {
+    return 0, nil
+  }
+
+  v := strings.ToLower(value)
+  v = strings.TrimSuffix(strings.TrimSuffix(v, "b"), "i")
+  i := strings.IndexFunc(v, func(r rune) bool {
+    return (r < '0' || r > '9') && r != '.'
+  })
+
+  unit := int64(1)
+  if i >= 0 {
+    var ok bool
+    unit, ok = sizeUnits[strings.TrimSpace(v[i:])]
+    if !ok {
+      return 0, fmt.Errorf("Invalid size unit: %s", value)
+    }
+    v = v[:i]
+  }
+
+  size, err := strconv.ParseFloat(v, 64)
+  if err != nil || size < 0 {
+    return 0, fmt.Errorf("Invalid size: %s", value)
+  }
+
+  return int64(size * float64(unit)), nil
+}
+
+// parseLimit parses a memory or bandwidth limit, which unlike other sizes
+// cannot be zero
+func parseLimit(value string) (int64, error) {
+  limit, err := ParseSize(value)
+  if err != nil {
+    return 0, err
+  } else if len(value) > 0 && limit == 0 {
+    return 0, fmt.Errorf("Limit must be greater than zero: %s", value)
+  }
+
+  return limit, nil
+}
+
+// parseCpuWeight parses the weight of a cgroup on the unified hierarchy
+func parseCpuWeight(value string) (uint64, error) {
+  if len(value) == 0 {
+    return 0, nil
+  }
+
+  weight, err := strconv.ParseUint(value, 10, 64)
+  if err != nil || weight < 1 || weight > 10000 {
+    return 0, fmt.Errorf("Invalid CPU weight, must be 1-10000: %s", value)
+  }
+
+  return weight, nil
+}
+
+// parseIops parses a limit of IO operations per second
+func parseIops(value string) (int64, error) {
+  if len(value) == 0 {
+    return 0, nil
+  }
+
+  iops, err := strconv.ParseInt(value, 10, 64)
+  if err != nil || iops <= 0 {
+    return 0, fmt.Errorf("Invalid IOPS: %s", value)
+  }
+
+  return iops, nil
+}
+
+// throttles returns the limits of the block device
+func (l *IOLimit) throttles() (rbps, wbps, riops, wiops *configs.ThrottleDevice, err error) {
+  var st unix.Stat_t
+  if err = unix.Stat(l.Device, &st); err != nil {
+    return nil, nil, nil, nil, fmt.Errorf("Invalid device %s: %s", l.Device, err)
+  }
+  if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+    return nil, nil, nil, nil, fmt.Errorf("Not a block device: %s", l.Device)
+  }
+
+  major := int64(unix.Major(uint64(st.Rdev)))
+  minor := int64(unix.Minor(uint64(st.Rdev)))
+
+  throttle := func(value string, parse func(string) (int64, error)) (*configs.ThrottleDevice, error) {
+    if len(value) == 0 {
+      return nil, nil
+    }
+
+    rate, err := parse(value)
+    if err != nil {
+      return nil, err
+    }
+
+    return configs.NewThrottleDevice(major, minor, uint64(rate)), nil
+  }
+
+  if rbps, err = throttle(l.ReadBps, parseLimit); err != nil {
+    return
+  }
+  if wbps, err = throttle(l.WriteBps, parseLimit); err != nil {
+    return
+  }
+  if riops, err = throttle(l.ReadIops, parseIops); err != nil {
+    return
+  }
+  wiops, err = throttle(l.WriteIops, parseIops)
+  return
+}
+
+// Validate checks that the limits can be parsed.  Devices are only checked
+// when the run's cgroup is configured.
+func (r *Resources) Validate() error {
+  if _, err := parseCpuWeight(r.CpuWeight); err != nil {
+    return err
+  }
+
+  if _, err := parseLimit(r.Memory); err != nil {
+    return err
+  }
+
+  for _, limit := range r.IO {
+    if len(limit.Device) == 0 {
+      return fmt.Errorf("IO limit is missing device")
+    }
+
+    for _, rate := range []string{limit.ReadBps, limit.WriteBps} {
+      if _, err := parseLimit(rate); err != nil {
+        return err
+      }
+    }
+
+    for _, iops := range []string{limit.ReadIops, limit.WriteIops} {
+      if _, err := parseIops(iops); err != nil {
+        return err
+      }
+    }
+  }
+
+  return nil
+}
+
+// Controllers returns the cgroup controllers which are needed to apply the
+// limits on the given hierarchy
+func (r *Resources) Controllers(mode string) []string {
+  var controllers []string
+  if r == nil {
+    return controllers
+  }
+
+  if len(r.Memory) > 0 {
+    controllers = append(controllers, "memory")
+  }
+
+  if len(r.IO) > 0 {
+    if mode == CgroupV2 {
+      controllers = append(controllers, "io")
+    } else {
+      controllers = append(controllers, "blkio")
+    }
+  }
+
+  return controllers
+}
+
+// apply sets the limits on the resources of the cgroup for the hierarchy.  On
+// the legacy hierarchy the CPU weight is converted to shares.
+func (r *Resources) apply(res *configs.Resources, mode string) error {
+  weight := uint64(0)
+  memory := ""
+  var limits []IOLimit
+  if r != nil {
+    var err error
+    if weight, err = parseCpuWeight(r.CpuWeight); err != nil {
+      return err
+    }
+    memory = r.Memory
+    limits = r.IO
+  }
+
+  if mode == CgroupV2 {
+    if weight == 0 {
+      weight = defaultCpuWeight
+    }
+    res.CpuWeight = weight
+  } else if weight > 0 {
+    // Inverse of cgroups.ConvertCPUSharesToCgroupV2Value
+    res.CpuShares = 2 + ((weight - 1) * 262142) / 9999
+  } else {
+    // Set the share to 100 so that the container has the whole CPU share
+    res.CpuShares = 100
+  }
+
+  var err error
+  if res.Memory, err = parseLimit(memory); err != nil {
+    return err
+  }
+
+  for _, limit := range limits {
+    rbps, wbps, riops, wiops, err := limit.throttles()
+    if err != nil {
+      return err
+    }
+
+    if rbps != nil {
+      res.BlkioThrottleReadBpsDevice = append(res.BlkioThrottleReadBpsDevice, rbps)
+    }
+    if wbps != nil {
+      res.BlkioThrottleWriteBpsDevice = append(res.BlkioThrottleWriteBpsDevice, wbps)
+    }
+    if riops != nil {
+      res.BlkioThrottleReadIOPSDevice = append(res.BlkioThrottleReadIOPSDevice, riops)
+    }
+    if wiops != nil {
+      res.BlkioThrottleWriteIOPSDevice = append(res.BlkioThrottleWriteIOPSDevice, wiops)
+    }
+  }
+
+  return nil
+}
+
+// RemoveCgroupParent removes the parent cgroup of the runs once it is empty
+func RemoveCgroupParent() error {
+  mode, err := CgroupMode()
+  if err != nil {
+    return err
+  }
+
+  if mode == CgroupV2 {
+    err = os.Remove(path.Join(cgroupRoot, CgroupParent))
+    if os.IsNotExist(err) {
+      return nil
+    }
+    return err
+  }
+
+  // The parent exists in the hierarchy of each controller
+  entries, err := ioutil.ReadDir(cgroupRoot)
+  if err != nil {
+    return err
+  }
+
+  for _, entry := range entries {
+    if !entry.IsDir() {
+      continue
+    }
+
+    err = os.Remove(path.Join(cgroupRoot, entry.Name(), CgroupParent))
+    if err != nil && !os.IsNotExist(err) {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// CgroupMode determines which cgroup hierarchy is mounted on the host
+func CgroupMode() (string, error) {
+  var st unix.Statfs_t
+  if err := unix.Statfs(cgroupRoot, &st); err != nil {
+    return "", err
+  }
+
+  if st.Type == unix.CGROUP2_SUPER_MAGIC {
+    return CgroupV2, nil
+  }
+
+  if err := unix.Statfs(path.Join(cgroupRoot, "unified"), &st); err == nil {
+    if st.Type == unix.CGROUP2_SUPER_MAGIC {
+      return CgroupHybrid, nil
+    }
+  }
+
+  return CgroupV1, nil
+}
+
+// CgroupControllers returns the controllers which are enabled and mounted on
+// the host
+func CgroupControllers() (map[string]bool, error) {
+  mode, err := CgroupMode()
+  if err != nil {
+    return nil, err
+  }
+
+  controllers := make(map[string]bool)
+
+  if mode == CgroupV2 {
+    dat, err := ioutil.ReadFile(path.Join(cgroupRoot, "cgroup.controllers"))
+    if err != nil {
+      return nil, err
+    }
+
+    for _, controller := range strings.Fields(string(dat)) {
+      controllers[controller] = true
+    }
+
+    return controllers, nil
+  }
+
+  f, err := os.Open("/proc/cgroups")
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  scanner := bufio.NewScanner(f)
+  for scanner.Scan() {
+    // #subsys_name hierarchy num_cgroups enabled
+    fields := strings.Fields(scanner.Text())
+    if len(fields) != 4 || strings.HasPrefix(fields[0], "#") {
+      continue
+    }
+
+    if fields[3] != "1" {
+      continue
+    }
+
+    if _, err := os.Stat(path.Join(cgroupRoot, fields[0])); err != nil {
+      continue
+    }
+
+    controllers[fields[0]] = true
+  }
+
+  return controllers, scanner.Err()
+}
+
+// RequiredCgroupControllers are the controllers used to confine each run
+func RequiredCgroupControllers(mode string) []string {
+  if mode == CgroupV2 {
+    // Devices are confined with eBPF on the unified hierarchy
+    return []string{"cpuset", "cpu"}
+  }
+
+  return []string{"cpuset", "cpu", "devices"}
+}
+
+// cpusetFile returns the path of a cpuset file of a cgroup relative to the
+// root of the cpuset hierarchy
+func cpusetFile(mode, cgroup, v1, v2 string) string {
+  if mode == CgroupV2 {
+    return path.Join(cgroupRoot, cgroup, v2)
+  }
+
+  return path.Join(cgroupRoot, "cpuset", cgroup, v1)
+}
+
+// CpusetEffective returns the CPUs which are available to cgroups under the
+// root cpuset
+func CpusetEffective() ([]int, error) {
+  mode, err := CgroupMode()
+  if err != nil {
+    return nil, err
+  }
+
+  file := cpusetFile(mode, "", "cpuset.effective_cpus", "cpuset.cpus.effective")
+  dat, err := ioutil.ReadFile(file)
+  if err != nil {
+    return nil, err
+  }
+
+  return ParseCpuList(string(dat))
+}
+
+// CpusetExclusive returns the CPUs which have been claimed exclusively by the
+// top-level cgroups of the host, indexed by the cgroup's name
+func CpusetExclusive() (map[string][]int, error) {
+  mode, err := CgroupMode()
+  if err != nil {
+    return nil, err
+  }
+
+  dir := cpusetFile(mode, "", "", "")
+  entries, err := ioutil.ReadDir(dir)
+  if err != nil {
+    return nil, err
+  }
+
+  exclusive := make(map[string][]int)
+
+  for _, entry := range entries {
+    if !entry.IsDir() {
+      continue
+    }
+
+    var flag string
+    if mode == CgroupV2 {
+      flag = cpusetFile(mode, entry.Name(), "", "cpuset.cpus.partition")
+    } else {
+      flag = cpusetFile(mode, entry.Name(), "cpuset.cpu_exclusive", "")
+    }
+
+    dat, err := ioutil.ReadFile(flag)
+    if err != nil {
+      continue
+    }
+
+    // Partitions on v2 are either "member", "root" or "isolated"
+    val := strings.TrimSpace(string(dat))
+    if val == "0" || strings.HasPrefix(val, "member") {
+      continue
+    }
+
+    dat, err = ioutil.ReadFile(
+      cpusetFile(mode, entry.Name(), "cpuset.cpus", "cpuset.cpus.effective"),
+    )
+    if err != nil {
+      continue
+    }
+
+    cpus, err := ParseCpuList(string(dat))
+    if err != nil {
+      return nil, err
+    }
+
+    exclusive[entry.Name()] = cpus
+  }
+
+  return exclusive, nil
+}
+
+// ParseCpuList parses a kernel CPU list, e.g. `0-3,8,10-11`
+func ParseCpuList(list string) ([]int, error) {
+  var cpus []int
+
+  list = strings.TrimSpace(list)
+  if len(list) == 0 {
+    return cpus, nil
+  }
+
+  for _, item := range strings.Split(list, ",") {
+    bounds := strings.SplitN(item, "-", 2)
+
+    start, err := strconv.Atoi(bounds[0])
+    if err != nil {
+      return nil, fmt.Errorf("Invalid CPU list: %s", list)
+    }
+
+    end := start
+    if len(bounds) == 2 {
+      end, err = strconv.Atoi(bounds[1])
+      if err != nil {
+        return nil, fmt.Errorf("Invalid CPU list: %s", list)
+      }
+    }
+
+    for cpu := start; cpu <= end; cpu++ {
+      cpus = append(cpus, cpu)
+    }
+  }
+
+  return cpus, nil
+}
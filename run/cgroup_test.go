@@ -0,0 +1,99 @@
+package run
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "testing"
+)
+
+func TestParseSize(t *testing.T) {
+  tests := []struct {
+    value string
+    size  int64
+    valid bool
+  }{
+    {"", 0, true},
+    {"0", 0, true},
+    {"0K", 0, true},
+    {"512", 512, true},
+    {"512b", 512, true},
+    {"4K", 4 << 10, true},
+    {"4k", 4 << 10, true},
+    {"4KB", 4 << 10, true},
+    {"4KiB", 4 << 10, true},
+    {"512M", 512 << 20, true},
+    {"1MiB", 1 << 20, true},
+    {"1.5G", 3 << 29, true},
+    {"2 GiB", 2 << 30, true},
+    {"1T", 1 << 40, true},
+    {"-1", 0, false},
+    {"-1M", 0, false},
+    {"1X", 0, false},
+    {"1KK", 0, false},
+    {"M", 0, false},
+    {"one", 0, false},
+  }
+
+  for _, test := range tests {
+    size, err := ParseSize(test.value)
+    if test.valid && err != nil {
+      t.Errorf("%q: %s", test.value, err)
+    } else if !test.valid && err == nil {
+      t.Errorf("%q: expected an error, got %d", test.value, size)
+    } else if size != test.size {
+      t.Errorf("%q: expected %d, got %d", test.value, test.size, size)
+    }
+  }
+}
+
+func TestResourceLimits(t *testing.T) {
+  tests := []struct {
+    res   Resources
+    valid bool
+  }{
+    {Resources{}, true},
+    {Resources{Memory: "512M"}, true},
+    {Resources{Memory: "0"}, false},
+    {Resources{Memory: "-512M"}, false},
+    {Resources{CpuWeight: "100"}, true},
+    {Resources{CpuWeight: "0"}, false},
+    {Resources{IO: []IOLimit{{Device: "/dev/sda", ReadBps: "100M", WriteIops: "1000"}}}, true},
+    {Resources{IO: []IOLimit{{Device: "/dev/sda", WriteBps: "0"}}}, false},
+    {Resources{IO: []IOLimit{{ReadBps: "100M"}}}, false},
+  }
+
+  for _, test := range tests {
+    err := test.res.Validate()
+    if (err == nil) != test.valid {
+      t.Errorf("%+v: expected valid %v, got %v", test.res, test.valid, err)
+    }
+  }
+}
@@ -31,11 +31,20 @@ package run
 // POSSIBILITY OF SUCH DAMAGE.
 
 import (
-	"net"
+  "os"
+  "fmt"
+  "net"
+  "path"
+  "sort"
+  "sync"
 
-	"github.com/lancs-net/netns/bridge"
-	"github.com/lancs-net/netns/network"
-	"github.com/opencontainers/runtime-spec/specs-go"
+  "github.com/vishvananda/netlink"
+  "github.com/cyphar/filepath-securejoin"
+  "github.com/lancs-net/netns/bridge"
+  "github.com/lancs-net/netns/network"
+  "github.com/lancs-net/netns/netutils"
+  "github.com/docker/libnetwork/iptables"
+  "github.com/opencontainers/runtime-spec/specs-go"
 
   "github.com/lancs-net/wayfinder/log"
 )
@@ -44,31 +53,281 @@ type Bridge struct {
   Name       string
   Interface  string
   Subnet     string
+  MTU        int
   CacheDir   string
-	netOpt     network.Opt
-	brOpt      bridge.Opt
-	client    *network.Client
+  Isolated   bool // whether to drop all traffic leaving the bridge
+  Hosts      map[string]string // static IPs of containers by name
+  netOpt     network.Opt
+  brOpt      bridge.Opt
+  mu         sync.Mutex
+  veths      map[string][]string // host-side veths indexed by container ID
+  rules    [][]string            // iptables rules added by this bridge
+  created    bool                // whether the bridge was created by us
 }
 
-// Init prepares netns
+// Init creates the bridge and its NAT rules to the host interface
 func (b *Bridge) Init(dryRun bool) error {
-  return nil
-}
+  b.mu.Lock()
+  defer b.mu.Unlock()
 
-// Create a veth pair with the bridge for the container
-func (b *Bridge) Create(s *specs.State) (net.IP, error) {
-  // Create the bridge using netns
-  b.netOpt.ContainerInterface = b.Interface
+  b.veths = make(map[string][]string)
   b.netOpt.BridgeName = b.Name
+  b.netOpt.StateDir = b.CacheDir
+  b.netOpt.ContainerInterface = b.Interface
   b.brOpt.Name = b.Name
   b.brOpt.IPAddr = b.Subnet
-  b.netOpt.StateDir = b.CacheDir
+  b.brOpt.MTU = b.MTU
 
-  log.Debugf("Creating bridge %s...", b.Name)
+  if dryRun {
+    log.Infof("Skipping creation of bridge %s (dry run)", b.Name)
+    return nil
+  }
+
+  // The host interface is used as the outbound route for all containers
+  if !b.Isolated {
+    if _, err := netlink.LinkByName(b.Interface); err != nil {
+      return fmt.Errorf("Could not find host interface %s: %s", b.Interface, err)
+    }
+  }
+
+  // Do not tear down a bridge which we did not create ourselves
+  if _, err := net.InterfaceByName(b.Name); err == nil {
+    log.Warnf("Bridge %s already exists, re-using it", b.Name)
+  } else {
+    b.created = true
+  }
+
+  log.Infof("Creating bridge %s (%s, mtu=%d)...", b.Name, b.Subnet, b.MTU)
+  if _, err := bridge.Init(b.brOpt); err != nil {
+    return err
+  }
+
+  // netns masquerades the subnet of every bridge it creates, which isolated
+  // bridges must not have
+  if b.Isolated {
+    err := netutils.SetupNATOut(b.Subnet, iptables.Delete)
+    if err != nil {
+      return fmt.Errorf("Could not delete NAT rule of %s: %s", b.Name, err)
+    }
+  }
+
+  // Masquerade traffic from the bridge out of the host interface and allow
+  // forwarding between both interfaces.  Isolated bridges instead drop any
+  // traffic which is routed in or out of the bridge or sent to the host.
+  rules := [][]string{
+    {
+      "POSTROUTING", "-t", "nat",
+      "-s", b.Subnet,
+      "-o", b.Interface,
+      "-j", "MASQUERADE",
+    },
+    {
+      "FORWARD",
+      "-i", b.Name,
+      "-o", b.Interface,
+      "-j", "ACCEPT",
+    },
+    {
+      "FORWARD",
+      "-i", b.Interface,
+      "-o", b.Name,
+      "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED",
+      "-j", "ACCEPT",
+    },
+  }
+  if b.Isolated {
+    rules = [][]string{
+      {
+        "FORWARD",
+        "-i", b.Name,
+        "!", "-o", b.Name,
+        "-j", "DROP",
+      },
+      {
+        "FORWARD",
+        "!", "-i", b.Name,
+        "-o", b.Name,
+        "-j", "DROP",
+      },
+      {
+        "INPUT",
+        "-i", b.Name,
+        "-j", "DROP",
+      },
+    }
+  }
+  for _, rule := range rules {
+    if err := b.addRule(rule); err != nil {
+      return fmt.Errorf("Could not set up rules for %s: %s", b.Name, err)
+    }
+  }
+
+  return nil
+}
+
+// addRule inserts an iptables rule if it does not already exist and
+// remembers it so it can be removed later.
+func (b *Bridge) addRule(rule []string) error {
+  if _, err := iptables.Raw(append([]string{"-C"}, rule...)...); err == nil {
+    return nil
+  }
+
+  output, err := iptables.Raw(append([]string{"-I"}, rule...)...)
+  if err != nil {
+    return err
+  } else if len(output) > 0 {
+    return &iptables.ChainError{
+      Chain:  rule[0],
+      Output: output,
+    }
+  }
+
+  b.rules = append(b.rules, rule)
+  return nil
+}
+
+// Create a veth pair with the bridge for the container and return the
+// container's IP and the name of the host-side veth.  The container is given
+// the static IP, if any, otherwise the next free IP of the bridge.
+func (b *Bridge) Create(s *specs.State, staticIP string) (net.IP, string, error) {
+  if b.veths == nil {
+    return nil, "", fmt.Errorf("Bridge %s has not been initialised", b.Name)
+  }
+
+  // Use a new client for each container as it is not safe to share
   client, err := network.New(b.netOpt)
   if err != nil {
-    return nil, err
+    return nil, "", err
+  }
+
+  // Remember the veth before it is created so that it is always cleaned up,
+  // even if it is only partially configured.
+  veth := fmt.Sprintf("%s-%d", network.DefaultPortPrefix, s.Pid)
+  b.mu.Lock()
+  b.veths[s.ID] = append(b.veths[s.ID], veth)
+  b.mu.Unlock()
+
+  log.Debugf("Attaching %s to bridge %s...", veth, b.Name)
+  ip, err := client.Create(s, b.brOpt, staticIP)
+  if err != nil {
+    return nil, veth, err
   }
-  
-  return client.Create(s, b.brOpt, "")
+
+  return ip, veth, nil
+}
+
+// Remove deletes the host-side veths which were created for the container
+func (b *Bridge) Remove(id string) error {
+  b.mu.Lock()
+  veths := b.veths[id]
+  delete(b.veths, id)
+  b.mu.Unlock()
+
+  var lastErr error
+  for _, veth := range veths {
+    // The kernel removes the pair itself when the netns is destroyed
+    link, err := netlink.LinkByName(veth)
+    if err != nil {
+      continue
+    }
+
+    log.Debugf("Deleting veth %s...", veth)
+    if err := netlink.LinkDel(link); err != nil {
+      lastErr = fmt.Errorf("Could not delete veth %s: %s", veth, err)
+    }
+  }
+
+  return lastErr
+}
+
+// Destroy removes all veths, NAT rules and the bridge itself if it was created
+// by us.  It is safe to call Destroy more than once.
+func (b *Bridge) Destroy(dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  b.mu.Lock()
+  var ids []string
+  for id := range b.veths {
+    ids = append(ids, id)
+  }
+  b.mu.Unlock()
+
+  for _, id := range ids {
+    if err := b.Remove(id); err != nil {
+      log.Warn(err)
+    }
+  }
+
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  // Remove the rules in the reverse order they were added
+  for i := len(b.rules) - 1; i >= 0; i-- {
+    _, err := iptables.Raw(append([]string{"-D"}, b.rules[i]...)...)
+    if err != nil {
+      log.Warnf("Could not delete iptables rule: %s", err)
+    }
+  }
+  b.rules = nil
+
+  if !b.created {
+    return nil
+  }
+
+  // Remove the outbound NAT rule which is added by netns with the bridge,
+  // unless it was already removed from the isolated bridge
+  if !b.Isolated {
+    err := netutils.SetupNATOut(b.Subnet, iptables.Delete)
+    if err != nil {
+      log.Warnf("Could not delete NAT rule: %s", err)
+    }
+  }
+
+  log.Infof("Deleting bridge %s...", b.Name)
+  err := bridge.Delete(b.Name)
+  if err != nil {
+    return err
+  }
+
+  b.created = false
+
+  return nil
+}
+
+// writeHosts appends the names of the containers of a bridge to the hosts file
+// of the rootfs
+func writeHosts(rootfs string, hosts map[string]string) error {
+  file, err := securejoin.SecureJoin(rootfs, "/etc/hosts")
+  if err != nil {
+    return err
+  }
+
+  err = os.MkdirAll(path.Dir(file), 0755)
+  if err != nil {
+    return err
+  }
+
+  var names []string
+  for name := range hosts {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+
+  f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+  if err != nil {
+    return err
+  }
+
+  defer f.Close()
+
+  for _, name := range names {
+    _, err = fmt.Fprintf(f, "%s\t%s\n", hosts[name], name)
+    if err != nil {
+      return err
+    }
+  }
+
+  return nil
 }
@@ -0,0 +1,86 @@
+package run
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "os"
+  "testing"
+  "io/ioutil"
+  "path/filepath"
+)
+
+func TestWriteHosts(t *testing.T) {
+  rootfs, err := ioutil.TempDir("", "rootfs")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(rootfs)
+
+  hosts := map[string]string{"server": "172.89.0.2", "client": "172.89.0.3"}
+
+  // The hosts file is created if the image does not have one
+  err = writeHosts(rootfs, hosts)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  file := filepath.Join(rootfs, "etc", "hosts")
+  dat, err := ioutil.ReadFile(file)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  expected := "172.89.0.3\tclient\n172.89.0.2\tserver\n"
+  if string(dat) != expected {
+    t.Errorf("expected %q, got %q", expected, dat)
+  }
+
+  // Otherwise the names are appended to the hosts of the image
+  err = ioutil.WriteFile(file, []byte("127.0.0.1\tlocalhost\n"), 0644)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  err = writeHosts(rootfs, hosts)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  dat, err = ioutil.ReadFile(file)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  expected = "127.0.0.1\tlocalhost\n" + expected
+  if string(dat) != expected {
+    t.Errorf("expected %q, got %q", expected, dat)
+  }
+}
@@ -0,0 +1,273 @@
+package run
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "os"
+  "fmt"
+  "math"
+  "time"
+  "strconv"
+  "strings"
+
+  "github.com/vishvananda/netlink"
+)
+
+// Netem describes the impairment of a run's network using tc/netem.  Values
+// are strings so that they can reference task parameters, e.g.
+// `delay: ${LATENCY_MS}ms`.  The impairment is applied to the egress of the
+// host side of the run's veth and therefore only affects the traffic towards
+// the run instance, not the traffic it sends.
+type Netem struct {
+  Delay     string `yaml:"delay"`
+  Jitter    string `yaml:"jitter"`
+  Loss      string `yaml:"loss"`
+  Duplicate string `yaml:"duplicate"`
+  Corrupt   string `yaml:"corrupt"`
+  Reorder   string `yaml:"reorder"`
+  Rate      string `yaml:"rate"`
+  Limit     string `yaml:"limit"`
+}
+
+// rateUnits are the units of tc rates in bits per second
+var rateUnits = map[string]uint64{
+  "bit":  1,
+  "kbit": 1000,
+  "mbit": 1000 * 1000,
+  "gbit": 1000 * 1000 * 1000,
+  "bps":  8,
+  "kbps": 8 * 1000,
+  "mbps": 8 * 1000 * 1000,
+  "gbps": 8 * 1000 * 1000 * 1000,
+}
+
+// Expand returns a copy of the impairment with all references to variables
+// replaced by the mapping function.
+func (n *Netem) Expand(mapping func(string) string) *Netem {
+  if n == nil {
+    return nil
+  }
+
+  return &Netem{
+    Delay:     strings.TrimSpace(os.Expand(n.Delay, mapping)),
+    Jitter:    strings.TrimSpace(os.Expand(n.Jitter, mapping)),
+    Loss:      strings.TrimSpace(os.Expand(n.Loss, mapping)),
+    Duplicate: strings.TrimSpace(os.Expand(n.Duplicate, mapping)),
+    Corrupt:   strings.TrimSpace(os.Expand(n.Corrupt, mapping)),
+    Reorder:   strings.TrimSpace(os.Expand(n.Reorder, mapping)),
+    Rate:      strings.TrimSpace(os.Expand(n.Rate, mapping)),
+    Limit:     strings.TrimSpace(os.Expand(n.Limit, mapping)),
+  }
+}
+
+// parseDelay parses a duration, where plain numbers are milliseconds, and
+// returns it in microseconds
+func parseDelay(value string) (uint32, error) {
+  if len(value) == 0 {
+    return 0, nil
+  }
+
+  var us float64
+  if ms, err := strconv.ParseFloat(value, 64); err == nil {
+    us = ms * 1000
+  } else if d, err := time.ParseDuration(value); err == nil {
+    us = float64(d.Microseconds())
+  } else {
+    return 0, fmt.Errorf("Invalid delay: %s", value)
+  }
+
+  // netem takes unsigned microseconds, which negative or huge delays would
+  // silently wrap around
+  if !(us >= 0 && us <= math.MaxUint32) {
+    return 0, fmt.Errorf("Invalid delay: %s", value)
+  }
+
+  return uint32(us), nil
+}
+
+// parsePercentage parses a percentage with or without the trailing %
+func parsePercentage(value string) (float32, error) {
+  if len(value) == 0 {
+    return 0, nil
+  }
+
+  p, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 32)
+  if err != nil || p < 0 || p > 100 {
+    return 0, fmt.Errorf("Invalid percentage: %s", value)
+  }
+
+  return float32(p), nil
+}
+
+// parseRate parses a tc-style rate and returns it in bytes per second.  Plain
+// numbers are in bytes per second, as with tc.
+func parseRate(value string) (uint64, error) {
+  if len(value) == 0 {
+    return 0, nil
+  }
+
+  value = strings.ToLower(value)
+  i := strings.IndexFunc(value, func(r rune) bool {
+    return (r < '0' || r > '9') && r != '.'
+  })
+
+  unit := uint64(8)
+  if i >= 0 {
+    var ok bool
+    unit, ok = rateUnits[strings.TrimSpace(value[i:])]
+    if !ok {
+      return 0, fmt.Errorf("Invalid rate unit: %s", value)
+    }
+    value = value[:i]
+  }
+
+  rate, err := strconv.ParseFloat(value, 64)
+  if err != nil || rate <= 0 {
+    return 0, fmt.Errorf("Invalid rate: %s", value)
+  }
+
+  return uint64(rate * float64(unit) / 8), nil
+}
+
+// qdiscs returns the netem qdisc and, if a rate is set, a tbf qdisc which is
+// attached as the child of netem.
+func (n *Netem) qdiscs(index int) ([]netlink.Qdisc, error) {
+  var err error
+  attrs := netlink.NetemQdiscAttrs{}
+
+  if attrs.Latency, err = parseDelay(n.Delay); err != nil {
+    return nil, err
+  }
+  if attrs.Jitter, err = parseDelay(n.Jitter); err != nil {
+    return nil, err
+  }
+  if attrs.Loss, err = parsePercentage(n.Loss); err != nil {
+    return nil, err
+  }
+  if attrs.Duplicate, err = parsePercentage(n.Duplicate); err != nil {
+    return nil, err
+  }
+  if attrs.CorruptProb, err = parsePercentage(n.Corrupt); err != nil {
+    return nil, err
+  }
+  if attrs.ReorderProb, err = parsePercentage(n.Reorder); err != nil {
+    return nil, err
+  }
+  if len(n.Limit) > 0 {
+    limit, err := strconv.ParseUint(n.Limit, 10, 32)
+    if err != nil {
+      return nil, fmt.Errorf("Invalid limit: %s", n.Limit)
+    }
+    attrs.Limit = uint32(limit)
+  }
+
+  qdiscs := []netlink.Qdisc{
+    netlink.NewNetem(netlink.QdiscAttrs{
+      LinkIndex: index,
+      Handle:    netlink.MakeHandle(1, 0),
+      Parent:    netlink.HANDLE_ROOT,
+    }, attrs),
+  }
+
+  rate, err := parseRate(n.Rate)
+  if err != nil {
+    return nil, err
+  } else if rate == 0 {
+    return qdiscs, nil
+  }
+
+  // Allow bursts of 4ms worth of traffic (with HZ=250) and queue up to 50ms
+  burst := uint32(rate / 250)
+  if burst < 1600 {
+    burst = 1600
+  }
+
+  qdiscs = append(qdiscs, &netlink.Tbf{
+    QdiscAttrs: netlink.QdiscAttrs{
+      LinkIndex: index,
+      Handle:    netlink.MakeHandle(10, 0),
+      Parent:    netlink.MakeHandle(1, 1),
+    },
+    Rate:   rate,
+    Buffer: uint32(netlink.Xmittime(rate, burst)),
+    Limit:  burst + uint32(rate / 20),
+  })
+
+  return qdiscs, nil
+}
+
+// Validate checks whether the impairment can be applied
+func (n *Netem) Validate() error {
+  _, err := n.qdiscs(0)
+  return err
+}
+
+// Apply the impairment to the egress of the named interface
+func (n *Netem) Apply(name string) error {
+  link, err := netlink.LinkByName(name)
+  if err != nil {
+    return fmt.Errorf("Could not find interface %s: %s", name, err)
+  }
+
+  qdiscs, err := n.qdiscs(link.Attrs().Index)
+  if err != nil {
+    return err
+  }
+
+  for _, qdisc := range qdiscs {
+    if err := netlink.QdiscReplace(qdisc); err != nil {
+      return fmt.Errorf("Could not apply %s to %s: %s", qdisc.Type(), name, err)
+    }
+  }
+
+  return nil
+}
+
+// String returns a tc-like description of the impairment
+func (n *Netem) String() string {
+  var opts []string
+  for _, opt := range [][2]string{
+    {"delay", n.Delay},
+    {"jitter", n.Jitter},
+    {"loss", n.Loss},
+    {"duplicate", n.Duplicate},
+    {"corrupt", n.Corrupt},
+    {"reorder", n.Reorder},
+    {"rate", n.Rate},
+    {"limit", n.Limit},
+  } {
+    if len(opt[1]) > 0 {
+      opts = append(opts, fmt.Sprintf("%s %s", opt[0], opt[1]))
+    }
+  }
+
+  return strings.Join(opts, " ")
+}
@@ -0,0 +1,80 @@
+package run
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "testing"
+)
+
+func TestParseDelay(t *testing.T) {
+  tests := []struct {
+    value string
+    us    uint32
+    valid bool
+  }{
+    {"", 0, true},
+    {"0", 0, true},
+    {"20", 20000, true},
+    {"0.5", 500, true},
+    {"20ms", 20000, true},
+    {"1.5s", 1500000, true},
+    {"250us", 250, true},
+    {"4294967295us", 4294967295, true},
+    {"-1", 0, false},
+    {"-5ms", 0, false},
+    {"4294967296us", 0, false},
+    {"1h30m", 0, false},
+    {"inf", 0, false},
+    {"NaN", 0, false},
+    {"20 ms", 0, false},
+    {"fast", 0, false},
+  }
+
+  for _, test := range tests {
+    us, err := parseDelay(test.value)
+    if !test.valid {
+      if err == nil {
+        t.Errorf("%q: expected an error, got %d", test.value, us)
+      }
+    } else if err != nil {
+      t.Errorf("%q: %s", test.value, err)
+    } else if us != test.us {
+      t.Errorf("%q: expected %dus, got %dus", test.value, test.us, us)
+    }
+  }
+}
+
+func TestNetemNegativeJitter(t *testing.T) {
+  n := &Netem{Delay: "10ms", Jitter: "-2ms"}
+  if err := n.Validate(); err == nil {
+    t.Errorf("expected an error for a negative jitter")
+  }
+}
@@ -0,0 +1,314 @@
+package run
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "os"
+  "fmt"
+  "path"
+  "bytes"
+  "regexp"
+  "strings"
+  "strconv"
+  "io/ioutil"
+  "path/filepath"
+  "text/template"
+  "encoding/json"
+
+  "gopkg.in/yaml.v2"
+  "github.com/cyphar/filepath-securejoin"
+)
+
+// Param is a parameter of a task as passed to a run
+type Param struct {
+  Name  string
+  Type  string
+  Value string
+}
+
+// ParamFile renders the parameters of a task into a file in the rootfs before
+// the run starts, for programs which do not read the environment
+type ParamFile struct {
+  Path     string `yaml:"path" schema:"required"`
+  Format   string `yaml:"format" schema:"enum=kconfig|json|yaml|env|template"`
+  Template string `yaml:"template"`
+  Prefix   string `yaml:"prefix"`
+}
+
+// kconfigLiteral matches Kconfig values which are written without quotes
+var kconfigLiteral = regexp.MustCompile(`^([ym]|-?[0-9]+|0[xX][0-9a-fA-F]+)$`)
+
+// Validate checks the format of the file and parses its template
+func (f *ParamFile) Validate() error {
+  if len(f.Path) == 0 {
+    return fmt.Errorf("Parameter file is missing a path")
+  } else if !path.IsAbs(f.Path) {
+    return fmt.Errorf("Path of parameter file must be absolute: %s", f.Path)
+  }
+
+  switch f.Format {
+  case "", "env", "kconfig", "json", "yaml":
+    if len(f.Template) > 0 {
+      return fmt.Errorf("Template is only used by the template format")
+    }
+  case "template":
+    _, err := f.template()
+    return err
+  default:
+    return fmt.Errorf("Unknown parameter file format: %s", f.Format)
+  }
+
+  return nil
+}
+
+// template parses the user-provided template of the file.  Unknown
+// parameters are an error rather than rendered as `<no value>`.
+func (f *ParamFile) template() (*template.Template, error) {
+  if len(f.Template) == 0 {
+    return nil, fmt.Errorf("Parameter file %s is missing a template", f.Path)
+  }
+
+  tmpl, err := template.New(f.Path).Option("missingkey=error").Parse(f.Template)
+  if err != nil {
+    return nil, fmt.Errorf("Invalid template for %s: %s", f.Path, err)
+  }
+
+  return tmpl, nil
+}
+
+// paramValues returns the values of the parameters by name, as used by
+// templates
+func paramValues(params []Param) map[string]string {
+  values := make(map[string]string)
+  for _, p := range params {
+    values[p.Name] = p.Value
+  }
+  return values
+}
+
+// typed returns the value of a parameter as a number or boolean if its type
+// allows it, so that structured formats do not quote them
+func (p Param) typed() interface{} {
+  switch p.Type {
+  case "int", "integer", "size":
+    if i, err := strconv.ParseInt(p.Value, 10, 64); err == nil {
+      return i
+    }
+  case "float":
+    if f, err := strconv.ParseFloat(p.Value, 64); err == nil {
+      return f
+    }
+  case "bool", "boolean":
+    if b, err := strconv.ParseBool(p.Value); err == nil {
+      return b
+    }
+  }
+
+  return p.Value
+}
+
+// Render returns the contents of the file for the parameters
+func (f *ParamFile) Render(params []Param) ([]byte, error) {
+  var buf bytes.Buffer
+
+  switch f.Format {
+  case "", "env":
+    for _, p := range params {
+      fmt.Fprintf(&buf, "export %s%s='%s'\n",
+        f.Prefix, p.Name, strings.Replace(p.Value, "'", `'\''`, -1),
+      )
+    }
+
+  case "kconfig":
+    prefix := f.Prefix
+    if len(prefix) == 0 {
+      prefix = "CONFIG_"
+    }
+
+    for _, p := range params {
+      name := p.Name
+      if !strings.HasPrefix(name, prefix) {
+        name = prefix + name
+      }
+
+      // The value of a choice is the option which is selected
+      if p.Type == "choice" {
+        name = p.Value
+        if !strings.HasPrefix(name, prefix) {
+          name = prefix + name
+        }
+        fmt.Fprintf(&buf, "%s=y\n", name)
+        continue
+      }
+
+      // Booleans are set or not set whatever their true and false values
+      if p.Type == "bool" || p.Type == "boolean" {
+        if b, err := strconv.ParseBool(p.Value); err == nil {
+          if b {
+            fmt.Fprintf(&buf, "%s=y\n", name)
+          } else {
+            fmt.Fprintf(&buf, "# %s is not set\n", name)
+          }
+          continue
+        }
+      }
+
+      switch {
+      case p.Value == "n":
+        fmt.Fprintf(&buf, "# %s is not set\n", name)
+      case kconfigLiteral.MatchString(p.Value):
+        fmt.Fprintf(&buf, "%s=%s\n", name, p.Value)
+      default:
+        fmt.Fprintf(&buf, "%s=%s\n", name, strconv.Quote(p.Value))
+      }
+    }
+
+  case "json":
+    values := make(map[string]interface{})
+    for _, p := range params {
+      values[f.Prefix+p.Name] = p.typed()
+    }
+
+    out, err := json.MarshalIndent(values, "", "  ")
+    if err != nil {
+      return nil, err
+    }
+
+    buf.Write(out)
+    buf.WriteString("\n")
+
+  case "yaml":
+    var values yaml.MapSlice
+    for _, p := range params {
+      values = append(values, yaml.MapItem{Key: f.Prefix + p.Name, Value: p.typed()})
+    }
+
+    out, err := yaml.Marshal(values)
+    if err != nil {
+      return nil, err
+    }
+
+    buf.Write(out)
+
+  case "template":
+    tmpl, err := f.template()
+    if err != nil {
+      return nil, err
+    }
+
+    err = tmpl.Execute(&buf, paramValues(params))
+    if err != nil {
+      return nil, fmt.Errorf("Could not render %s: %s", f.Path, err)
+    }
+
+  default:
+    return nil, fmt.Errorf("Unknown parameter file format: %s", f.Format)
+  }
+
+  return buf.Bytes(), nil
+}
+
+// Write renders the file for the parameters into the rootfs
+func (f *ParamFile) Write(rootfs string, params []Param) error {
+  out, err := f.Render(params)
+  if err != nil {
+    return err
+  }
+
+  // The path must not escape the rootfs through symlinks within the image
+  dest, err := securejoin.SecureJoin(rootfs, f.Path)
+  if err != nil {
+    return err
+  }
+
+  err = os.MkdirAll(path.Dir(dest), os.ModePerm)
+  if err != nil {
+    return err
+  }
+
+  return ioutil.WriteFile(dest, out, 0644)
+}
+
+// Render renders the source of a templated input, or every file within it if
+// it is a directory, with the parameters into dest.  Templates use the syntax
+// of text/template, e.g. `{{.NUM_WORKERS}}`, and referencing an unknown
+// parameter is an error.  Without a dest, the templates are only checked.
+func (in *Input) Render(dest string, params []Param) error {
+  values := paramValues(params)
+
+  return filepath.Walk(in.Source, func(src string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+
+    rel, err := filepath.Rel(in.Source, src)
+    if err != nil {
+      return err
+    }
+
+    target := filepath.Join(dest, rel)
+    if info.IsDir() {
+      if len(dest) == 0 {
+        return nil
+      }
+      return os.MkdirAll(target, info.Mode().Perm())
+    } else if !info.Mode().IsRegular() {
+      return nil
+    }
+
+    dat, err := ioutil.ReadFile(src)
+    if err != nil {
+      return err
+    }
+
+    tmpl, err := template.New(src).Option("missingkey=error").Parse(string(dat))
+    if err != nil {
+      return err
+    }
+
+    var buf bytes.Buffer
+    err = tmpl.Execute(&buf, values)
+    if err != nil {
+      return err
+    }
+
+    if len(dest) == 0 {
+      return nil
+    }
+
+    err = os.MkdirAll(filepath.Dir(target), os.ModePerm)
+    if err != nil {
+      return err
+    }
+
+    return ioutil.WriteFile(target, buf.Bytes(), info.Mode().Perm())
+  })
+}
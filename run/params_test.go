@@ -0,0 +1,139 @@
+package run
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "os"
+  "testing"
+  "io/ioutil"
+  "path/filepath"
+)
+
+func TestRenderKconfig(t *testing.T) {
+  f := &ParamFile{Path: "/config", Format: "kconfig"}
+  out, err := f.Render([]Param{
+    {Name: "A", Type: "bool", Value: "true"},
+    {Name: "B", Type: "boolean", Value: "false"},
+    {Name: "C", Type: "bool", Value: "y"},
+    {Name: "D", Type: "bool", Value: "n"},
+    {Name: "E", Type: "string", Value: "n"},
+    {Name: "F", Type: "string", Value: "m"},
+    {Name: "G", Type: "integer", Value: "-4"},
+    {Name: "H", Type: "string", Value: "0x1F"},
+    {Name: "I", Type: "string", Value: `say "hi"`},
+    {Name: "CONFIG_J", Type: "string", Value: "y"},
+    {Name: "SCHED", Type: "choice", Value: "SCHED_RR"},
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  expected := `CONFIG_A=y
+# CONFIG_B is not set
+CONFIG_C=y
+# CONFIG_D is not set
+# CONFIG_E is not set
+CONFIG_F=m
+CONFIG_G=-4
+CONFIG_H=0x1F
+CONFIG_I="say \"hi\""
+CONFIG_J=y
+CONFIG_SCHED_RR=y
+`
+  if string(out) != expected {
+    t.Errorf("expected:\n%s\ngot:\n%s", expected, out)
+  }
+}
+
+func TestParamFileValidate(t *testing.T) {
+  tests := []struct {
+    file  ParamFile
+    valid bool
+  }{
+    {ParamFile{Path: "/config"}, true},
+    {ParamFile{Path: "/config", Format: "kconfig"}, true},
+    {ParamFile{Path: "/config", Format: "template", Template: "{{.A}}"}, true},
+    {ParamFile{}, false},
+    {ParamFile{Path: "config"}, false},
+    {ParamFile{Path: "../config"}, false},
+    {ParamFile{Path: "/config", Format: "ini"}, false},
+    {ParamFile{Path: "/config", Template: "{{.A}}"}, false},
+    {ParamFile{Path: "/config", Format: "template"}, false},
+    {ParamFile{Path: "/config", Format: "template", Template: "{{.A"}, false},
+  }
+
+  for _, test := range tests {
+    err := test.file.Validate()
+    if (err == nil) != test.valid {
+      t.Errorf("%+v: expected valid %v, got %v", test.file, test.valid, err)
+    }
+  }
+}
+
+func TestParamFileWrite(t *testing.T) {
+  dir, err := ioutil.TempDir("", "params")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  rootfs := filepath.Join(dir, "rootfs")
+  err = os.MkdirAll(filepath.Join(rootfs, "etc"), 0755)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // A symlink within the image must not lead outside of the rootfs
+  err = os.Symlink(dir, filepath.Join(rootfs, "etc", "escape"))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  f := &ParamFile{Path: "/etc/escape/params.env"}
+  err = f.Write(rootfs, []Param{{Name: "A", Type: "string", Value: "it's"}})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if _, err := os.Stat(filepath.Join(dir, "params.env")); err == nil {
+    t.Fatal("parameter file was written outside of the rootfs")
+  }
+
+  out, err := ioutil.ReadFile(filepath.Join(rootfs, dir, "params.env"))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  expected := "export A='it'\\''s'\n"
+  if string(out) != expected {
+    t.Errorf("expected %q, got %q", expected, out)
+  }
+}
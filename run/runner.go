@@ -35,12 +35,12 @@ import (
   "fmt"
   "time"
   "path"
-  "regexp"
   "strings"
 
   "golang.org/x/sys/unix"
   "github.com/otiai10/copy"
   "github.com/novln/docker-parser"
+  "github.com/cyphar/filepath-securejoin"
   "github.com/opencontainers/runc/libcontainer"
   "github.com/opencontainers/runtime-spec/specs-go"
   "github.com/opencontainers/runc/libcontainer/specconv"
@@ -49,6 +49,18 @@ import (
   "github.com/lancs-net/wayfinder/log"
 )
 
+const (
+  // NetworkNone provides the run with only a loopback interface
+  NetworkNone     = "none"
+  // NetworkIsolated attaches the run to a private bridge shared only by the
+  // runs of the same task
+  NetworkIsolated = "isolated"
+  // NetworkBridged attaches the run to the job's bridge (default)
+  NetworkBridged  = "bridged"
+  // NetworkHost shares the host's network namespace with the run
+  NetworkHost     = "host"
+)
+
 var (
   defaultEnvironment = []string{
     "TERM=xterm",
@@ -74,13 +86,25 @@ var (
 )
 
 type Run struct {
-  Name           string `yaml:"name"`
-  Image          string `yaml:"image"`
+  Name           string `yaml:"name" schema:"required"`
+  Image          string `yaml:"image" schema:"required"`
+  Extends        string `yaml:"extends"`
   Cores          int    `yaml:"cores"`
   Devices      []string `yaml:"devices"`
   Cmd            string `yaml:"cmd"`
   Path           string `yaml:"path"`
-  Capabilities []string
+  Network        string `yaml:"network" schema:"enum=none|isolated|bridged|host"`
+  Concurrent     bool   `yaml:"concurrent"`
+  Netem         *Netem  `yaml:"netem"`
+  Resources     *Resources `yaml:"resources"`
+  ParamFile     *ParamFile `yaml:"param_file"`
+  Env            map[string]string `yaml:"env"`
+  Workdir        string `yaml:"workdir"`
+  User           string `yaml:"user"`
+  Shell          string `yaml:"shell"`
+  Entrypoint   []string `yaml:"entrypoint"`
+  Args         []string `yaml:"args"`
+  Capabilities []string `yaml:"capabilities"`
   exitCode       int
   maxRetries     int
 }
@@ -93,18 +117,67 @@ type Runner struct {
   timer       time.Time
   out      *[]Output
   rootfs      string
+  args      []string
+  succeeded   bool
 }
 
 type Input struct {
   Name             string `yaml:"name"`
-  Source           string `yaml:"source"`
-  Destination      string `yaml:"destination"`
+  Source           string `yaml:"source" schema:"required"`
+  Destination      string `yaml:"destination" schema:"required"`
   Options        []string `yaml:"options"`
+  Template         bool   `yaml:"template"`
 }
 
+// Output is an artifact which is collected from the rootfs of the run which
+// produces it and copied into the runs which consume it
 type Output struct {
   Name             string `yaml:"name"`
-  Path             string `yaml:"path"`
+  Path             string `yaml:"path" schema:"required"`
+  Producer         string `yaml:"producer"`
+  Consumers      []string `yaml:"consumers"`
+  Keep            *bool   `yaml:"keep"`
+}
+
+// ProducedBy returns whether the output is collected after the named run.
+// Outputs without a producer are collected after every run.
+func (o *Output) ProducedBy(run string) bool {
+  return len(o.Producer) == 0 || o.Producer == run
+}
+
+// ConsumedBy returns whether the output is copied into the named run.
+// Outputs without consumers are copied into every run.
+func (o *Output) ConsumedBy(run string) bool {
+  if len(o.Consumers) == 0 {
+    return true
+  }
+
+  for _, consumer := range o.Consumers {
+    if consumer == run {
+      return true
+    }
+  }
+
+  return false
+}
+
+// Kept returns whether the output is kept in the results once it has been
+// consumed, which is the default
+func (o *Output) Kept() bool {
+  return o.Keep == nil || *o.Keep
+}
+
+// LastConsumer returns the last of the runs, in order, which consumes the
+// output
+func (o *Output) LastConsumer(runs []string) string {
+  last := ""
+  for _, run := range runs {
+    if o.ConsumedBy(run) {
+      last = run
+    }
+  }
+
+  return last
 }
 
 type RunnerConfig struct {
@@ -120,8 +193,20 @@ type RunnerConfig struct {
   AllowOverride    bool
   Inputs        *[]Input
   Outputs       *[]Output
+  Runs           []string // names of all runs of the task, in order
   Env            []string
   Capabilities   []string
+  Network          string
+  Netem           *Netem
+  Resources       *Resources
+  Params         []Param
+  ParamFile       *ParamFile
+  Workdir          string
+  User             string
+  Shell            string
+  Entrypoint     []string
+  Args           []string
+  Quiet            bool
 }
 
 // NewRunner returns the name of the 
@@ -175,6 +260,16 @@ func (r *Runner) Init(in *[]Input, out *[]Output, dryRun bool) error {
 
   // Copy inputs into the rootfs
   for _, input := range *in {
+    // Templated inputs are rendered with the task's parameters instead
+    if input.Template {
+      r.log.Debugf("Rendering input into rootfs: %s", input.Source)
+      err := input.Render(path.Join(r.rootfs, input.Destination), r.Config.Params)
+      if err != nil {
+        return fmt.Errorf("Could not render input: %s", err)
+      }
+      continue
+    }
+
     r.log.Debugf("Copying input into rootfs: %s", input.Source)
     err := copy.Copy(
       input.Source,
@@ -185,20 +280,52 @@ func (r *Runner) Init(in *[]Input, out *[]Output, dryRun bool) error {
     }
   }
 
-  // Copy outputs between runs
+  // Let the runs of a private network reach each other by name
+  if r.Config.Network == NetworkIsolated && r.Bridge != nil && len(r.Bridge.Hosts) > 0 {
+    err := writeHosts(r.rootfs, r.Bridge.Hosts)
+    if err != nil {
+      return fmt.Errorf("Could not write hosts: %s", err)
+    }
+  }
+
+  // Render the task's parameters into the rootfs
+  if r.Config.ParamFile != nil {
+    r.log.Debugf("Writing parameters into rootfs: %s", r.Config.ParamFile.Path)
+    err := r.Config.ParamFile.Write(r.rootfs, r.Config.Params)
+    if err != nil {
+      return fmt.Errorf("Could not write parameter file: %s", err)
+    }
+  }
+
+  // Create the working directory if the image does not have it, without
+  // following symlinks within the image out of the rootfs
+  if len(r.Config.Workdir) > 0 {
+    workdir, err := securejoin.SecureJoin(r.rootfs, r.Config.Workdir)
+    if err != nil {
+      return fmt.Errorf("Could not resolve working directory: %s", err)
+    }
+
+    err = os.MkdirAll(workdir, 0755)
+    if err != nil {
+      return fmt.Errorf("Could not create working directory: %s", err)
+    }
+  }
+
+  // Copy the outputs which this run consumes from the previous runs
   for _, output := range *out {
+    src := path.Join(r.Config.ResultsDir, output.Path)
+    if !output.ConsumedBy(r.Config.Name) {
+      continue
+    } else if _, err := os.Stat(src); os.IsNotExist(err) {
+      r.log.Debugf("Output not yet produced: %s", output.Path)
+      continue
+    }
+
     r.log.Debugf("Copying output into rootfs: %s", output.Path)
-    err := copy.Copy(
-      path.Join(r.Config.ResultsDir, output.Path),
-      path.Join(r.rootfs, output.Path),
-    )
-    rmerr := os.Remove(path.Join(r.Config.ResultsDir, output.Path))
+    err := copy.Copy(src, path.Join(r.rootfs, output.Path))
     if err != nil {
       r.log.Warnf("Could not copy result: %s", err)
     }
-    if rmerr != nil {
-      r.log.Warnf("Could not delete result: %s", rmerr)
-    }
   }
 
   r.log.Debug("Initialising runc container...")
@@ -282,6 +409,26 @@ func (r *Runner) Init(in *[]Input, out *[]Output, dryRun bool) error {
     allowedDeviceRules = append(allowedDeviceRules, &device.DeviceRule)
   }
 
+  // The cgroup of the run is configured depending on the host's hierarchy
+  mode, err := CgroupMode()
+  if err != nil {
+    return fmt.Errorf("Could not determine cgroup hierarchy: %s", err)
+  }
+
+  resources := &configs.Resources{
+    MemorySwappiness: nil,
+    Devices:          allowedDeviceRules,
+    // Join the core ids together in a comma separated listed
+    CpusetCpus:       strings.Trim(
+      strings.Join(strings.Fields(fmt.Sprint(r.Config.CoreIds)), ","), "[]",
+    ),
+  }
+
+  err = r.Config.Resources.apply(resources, mode)
+  if err != nil {
+    return err
+  }
+
   capabilities := defaultCapabilities
   for _, capability := range r.Config.Capabilities {
     capabilities = append(capabilities, capability)
@@ -301,21 +448,11 @@ func (r *Runner) Init(in *[]Input, out *[]Output, dryRun bool) error {
       {Type: configs.NEWUTS},
       {Type: configs.NEWIPC},
       {Type: configs.NEWPID},
-      {Type: configs.NEWNET},
     }),
     Cgroups: &configs.Cgroup{
       Name:      r.log.Prefix,
-      Parent:    "",
-      Resources: &configs.Resources{
-        MemorySwappiness: nil,
-        Devices:          allowedDeviceRules,
-        // Join the core ids together in a comma separated listed
-        CpusetCpus:       strings.Trim(
-          strings.Join(strings.Fields(fmt.Sprint(r.Config.CoreIds)), ","), "[]",
-        ),
-        // Set the share to 100 so that the container has the whole CPU share
-        CpuShares:        100,
-      },
+      Parent:    CgroupParent,
+      Resources: resources,
     },
     MaskPaths: []string{
       "/proc/acpi",
@@ -385,13 +522,6 @@ func (r *Runner) Init(in *[]Input, out *[]Output, dryRun bool) error {
         Flags:       defaultMountFlags | unix.MS_RDONLY,
       },
     },
-    Networks: []*configs.Network{
-      {
-        Type:    "loopback",
-        Address: "127.0.0.1/0",
-        Gateway: "localhost",
-      },
-    },
     Rlimits: []configs.Rlimit{
       {
         Type: unix.RLIMIT_NOFILE,
@@ -400,19 +530,6 @@ func (r *Runner) Init(in *[]Input, out *[]Output, dryRun bool) error {
       },
     },
     Hooks: configs.Hooks{
-      configs.Prestart: configs.HookList{
-        configs.NewFunctionHook(func(s *specs.State) error {
-          ip, err := r.Bridge.Create(s)
-          if err != nil {
-            return err
-          }
-
-          r.log.Debugf("Container IP: %s", ip)
-
-          return nil
-        }),
-      },
-
       // The `StartContainer` hook is the closest way to run code before the
       // process is executed by libcontainer[0].  However, this configuration is
       // passed via a JSON serialized object which uses a path path to an
@@ -430,16 +547,84 @@ func (r *Runner) Init(in *[]Input, out *[]Output, dryRun bool) error {
     },
   }
 
+  // Give the run its own view of the unified hierarchy so that only its own
+  // cgroup is visible under /sys/fs/cgroup
+  if mode == CgroupV2 {
+    config.Namespaces = append(config.Namespaces, configs.Namespace{
+      Type: configs.NEWCGROUP,
+    })
+  }
+
+  // Set up the network namespace depending on the run's network mode
+  switch r.Config.Network {
+  case NetworkHost:
+    r.log.Debugf("Using host network")
+    if r.Config.Netem != nil {
+      return fmt.Errorf("Cannot apply netem to the host network")
+    }
+
+  case NetworkNone, NetworkIsolated, NetworkBridged, "":
+    config.Namespaces = append(config.Namespaces, configs.Namespace{
+      Type: configs.NEWNET,
+    })
+    config.Networks = []*configs.Network{
+      {
+        Type:    "loopback",
+        Address: "127.0.0.1/0",
+        Gateway: "localhost",
+      },
+    }
+
+    // Only attach to a bridge if the run requires connectivity
+    if r.Config.Network == NetworkNone {
+      if r.Config.Netem != nil {
+        return fmt.Errorf("Cannot apply netem without a network")
+      }
+      break
+    } else if r.Bridge == nil {
+      return fmt.Errorf("No bridge available for network mode: %s", r.Config.Network)
+    }
+
+    config.Hooks[configs.Prestart] = configs.HookList{
+      configs.NewFunctionHook(func(s *specs.State) error {
+        ip, veth, err := r.Bridge.Create(s, r.Bridge.Hosts[r.Config.Name])
+        if err != nil {
+          return err
+        }
+
+        r.log.Debugf("Container IP: %s (%s on %s)", ip, veth, r.Bridge.Name)
+
+        // Impair the traffic towards the container on the host-side veth
+        if r.Config.Netem != nil {
+          r.log.Infof("Applying netem to %s: %s", veth, r.Config.Netem)
+          err = r.Config.Netem.Apply(veth)
+          if err != nil {
+            return err
+          }
+        }
+
+        return nil
+      }),
+    }
+
+  default:
+    return fmt.Errorf("Unknown network mode: %s", r.Config.Network)
+  }
+
   // Save the list of outputs for later
   r.out = out
 
-  // Set the argument as either the path or the cmd of the run
-  if r.Config.Cmd != "" {
-    entrypoint := path.Join("root", "entrypoint.sh")
-    entrypointPath := path.Join(r.rootfs, entrypoint)
+  // Set the arguments of the process, which fails if the shell of the cmd or
+  // the executable does not exist in the image
+  r.args, err = r.processArgs(append(defaultEnvironment, r.Config.Env...))
+  if err != nil {
+    return err
+  }
 
+  // Write the cmd of the run to the script interpreted by the shell
+  if r.Config.Cmd != "" {
     f, err := os.OpenFile(
-      entrypointPath,
+      path.Join(r.rootfs, entrypointPath),
       os.O_CREATE|os.O_WRONLY|os.O_TRUNC,
       os.ModePerm,
     )
@@ -447,12 +632,6 @@ func (r *Runner) Init(in *[]Input, out *[]Output, dryRun bool) error {
       return fmt.Errorf("Could not create temporary cmd file: %s", err)
     }
 
-    // TODO: bash may not exist in the environment
-    _, err = f.WriteString("#!/usr/bin/env bash\n")
-    if err != nil {
-      return fmt.Errorf("Could not write to temporary cmd file: %s", err)
-    }
-
     _, err = f.WriteString(r.Config.Cmd)
     if err != nil {
       return fmt.Errorf("Could not write to temporary cmd file: %s", err)
@@ -475,22 +654,33 @@ func (r *Runner) Run() (int, time.Duration, error) {
     return 1, -1, fmt.Errorf("Cannot run container, missing initialization")
   }
 
+  // Capture the output of the run with the results of the task
+  stdout, stderr, err := r.captureOutput()
+  if err != nil {
+    return 1, -1, err
+  }
+
+  defer stdout.Close()
+  defer stderr.Close()
+
   taskProcess := &libcontainer.Process{
     Cwd:    "/",
     Env:    append(defaultEnvironment, r.Config.Env...),
     User:   "root",
-    Stdout: r.log,
-    Stderr: r.log,
+    Stdout: stdout,
+    Stderr: stderr,
     Init:   true,
   }
-
-  if r.Config.Path != "" {
-    taskProcess.Args = []string{r.Config.Path}
-  } else if r.Config.Cmd != "" {
-    taskProcess.Args = []string{"/root/entrypoint.sh"}
+  if len(r.Config.Workdir) > 0 {
+    taskProcess.Cwd = r.Config.Workdir
   }
+  if len(r.Config.User) > 0 {
+    taskProcess.User = r.Config.User
+  }
+
+  taskProcess.Args = r.args
 
-  err := r.container.Run(taskProcess)
+  err = r.container.Run(taskProcess)
   if err != nil {
     return 1, -1, fmt.Errorf("Could not run task process: %s", err)
   }
@@ -501,19 +691,7 @@ func (r *Runner) Run() (int, time.Duration, error) {
     return 1, -1, fmt.Errorf("Could not wait for container to finish: %s", err)
   }
 
-  //Check if the run was a run job. If yes, delete kernel files.
-  for _, output := range *r.out {
-    runbool, _ := regexp.MatchString(`run`, r.Config.Name)
-    usrbool, _ := regexp.MatchString(`usr`, output.Path)
-    btbool, _ := regexp.MatchString(`buildtime.txt`, output.Path)
-    if runbool && usrbool && !btbool {
-      r.log.Debugf("Deleting result: %s", output.Path)
-      err := os.Remove(path.Join(r.rootfs, output.Path))
-      if err != nil {
-        r.log.Warnf("Could not delete result: %s", err)
-      }
-    }
-  }
+  r.succeeded = state.ExitCode() == 0
 
   return state.ExitCode(), time.Since(r.timer), nil
 }
@@ -523,13 +701,26 @@ func (r *Runner) Destroy() error {
   if r.container != nil {
     r.log.Debugf("Destroying container")
 
-    // Copy output files to results directory from the container's rootfs
     for _, output := range *r.out {
+      dest := path.Join(r.Config.ResultsDir, output.Path)
+
+      // Discard outputs which are not kept once their last consumer succeeded,
+      // so that it can still be retried otherwise
+      if !output.Kept() && output.LastConsumer(r.Config.Runs) == r.Config.Name &&
+         r.succeeded {
+        r.log.Debugf("Discarding result: %s", output.Path)
+        err := os.RemoveAll(dest)
+        if err != nil {
+          r.log.Warnf("Could not delete result: %s", err)
+        }
+        continue
+      } else if !output.ProducedBy(r.Config.Name) {
+        continue
+      }
+
+      // Copy output files to results directory from the container's rootfs
       r.log.Debugf("Copying result: %s", output.Path)
-      err := copy.Copy(
-        path.Join(r.rootfs, output.Path),
-        path.Join(r.Config.ResultsDir, output.Path),
-      )
+      err := copy.Copy(path.Join(r.rootfs, output.Path), dest)
       if err != nil {
         r.log.Warnf("Could not copy result: %s", err)
       }
@@ -544,6 +735,14 @@ func (r *Runner) Destroy() error {
 
     r.container.Destroy()
     r.container = nil
+
+    // Remove any veths which are left over from the container
+    if r.Bridge != nil {
+      err = r.Bridge.Remove(r.log.Prefix)
+      if err != nil {
+        r.log.Warnf("Could not remove network: %s", err)
+      }
+    }
     
     // Delete the directory
     dir := path.Join(
@@ -0,0 +1,119 @@
+package run
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Authors: Alexander Jung <a.jung@lancs.ac.uk>
+//
+// Copyright (c) 2020, Lancaster University.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+import (
+  "os"
+  "fmt"
+  "path"
+  "strings"
+
+  "github.com/cyphar/filepath-securejoin"
+)
+
+// DefaultShell interprets the cmd of runs which do not set a shell
+const DefaultShell = "bash"
+
+// entrypointPath is where the cmd of a run is written within the rootfs
+const entrypointPath = "/root/entrypoint.sh"
+
+// lookPath finds an executable within the rootfs, either by its path or by
+// searching the PATH of the environment.  Symbolic links, such as `/bin/sh`
+// pointing to busybox, are resolved within the rootfs rather than the host.
+func lookPath(rootfs, name string, env []string) (string, error) {
+  var candidates []string
+  if strings.Contains(name, "/") {
+    candidates = []string{name}
+  } else {
+    dirs := ""
+    for _, e := range env {
+      if strings.HasPrefix(e, "PATH=") {
+        dirs = strings.TrimPrefix(e, "PATH=")
+      }
+    }
+
+    for _, dir := range strings.Split(dirs, ":") {
+      if len(dir) > 0 {
+        candidates = append(candidates, path.Join(dir, name))
+      }
+    }
+  }
+
+  for _, candidate := range candidates {
+    p, err := securejoin.SecureJoin(rootfs, candidate)
+    if err != nil {
+      continue
+    }
+
+    info, err := os.Stat(p)
+    if err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0 {
+      return candidate, nil
+    }
+  }
+
+  return "", fmt.Errorf("%s not found in image", name)
+}
+
+// processArgs returns the arguments of the run's process, which is either its
+// path, its entrypoint or its cmd interpreted by its shell, followed by its
+// args.  The executable is checked to exist in the rootfs, so that a missing
+// shell fails before the container starts.
+func (r *Runner) processArgs(env []string) ([]string, error) {
+  var args []string
+  isShell := false
+
+  switch {
+  case len(r.Config.Entrypoint) > 0:
+    args = append(args, r.Config.Entrypoint...)
+  case len(r.Config.Path) > 0:
+    args = append(args, r.Config.Path)
+  case len(r.Config.Cmd) > 0:
+    shell := r.Config.Shell
+    if len(strings.TrimSpace(shell)) == 0 {
+      shell = DefaultShell
+    }
+    args = append(strings.Fields(shell), entrypointPath)
+    isShell = true
+  default:
+    return nil, fmt.Errorf("Run did not specify path, cmd or entrypoint")
+  }
+
+  _, err := lookPath(r.rootfs, args[0], env)
+  if err != nil && isShell {
+    return nil, fmt.Errorf(
+      "Could not find shell: %s, set the shell of the run, e.g. /bin/sh", err,
+    )
+  } else if err != nil {
+    return nil, fmt.Errorf("Could not find executable: %s", err)
+  }
+
+  return append(args, r.Config.Args...), nil
+}